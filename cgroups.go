@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupManager puts a container into its cgroups and applies the resource
+// limits of the spec.
+type cgroupManager interface {
+	// Apply creates the cgroups and moves process pid into them.
+	Apply(pid int) error
+	// Set applies r to the cgroups.
+	Set(r *specs.LinuxResources) error
+	// Destroy removes the cgroups, once the processes in them are gone.
+	Destroy() error
+	// Paths returns the cgroup directories by subsystem, kept in the state
+	// to find the cgroups again.
+	Paths() map[string]string
+}
+
+// containerCgroupsPath returns linux.cgroupsPath, runns/<id> by default. A
+// relative path is below the cgroups of runns itself for cgroup v1, and
+// next to it for v2.
+func containerCgroupsPath(spec *specs.Spec, ncName string) string {
+	if spec.Linux != nil && spec.Linux.CgroupsPath != "" {
+		return spec.Linux.CgroupsPath
+	}
+	return filepath.Join("runns", ncName)
+}
+
+// cgroupRoot is where the cgroup hierarchies are mounted, or the unified
+// hierarchy of cgroup v2.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup2SuperMagic is the filesystem type of cgroup v2, from
+// include/uapi/linux/magic.h
+const cgroup2SuperMagic = 0x63677270
+
+// isCgroupV2 tells whether cgroupRoot is the unified hierarchy. Hosts
+// with cgroup v1, or v1 and v2 mounted side by side, have a tmpfs there.
+func isCgroupV2() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &st); err != nil {
+		return false
+	}
+	return st.Type == cgroup2SuperMagic
+}
+
+func newCgroupManager(spec *specs.Spec, ncName string) (cgroupManager, error) {
+	if isCgroupV2() {
+		return newCgroupV2(containerCgroupsPath(spec, ncName))
+	}
+	return newCgroupV1(containerCgroupsPath(spec, ncName))
+}
+
+// loadCgroupManager returns the manager of the cgroups at paths, which
+// Paths returned before.
+func loadCgroupManager(paths map[string]string) cgroupManager {
+	if dir, ok := paths[cgroupV2Key]; ok {
+		return &cgroupV2{dir: dir}
+	}
+	return &cgroupV1{paths: paths}
+}
+
+// hasResourceLimits tells whether r limits anything runns manages.
+func hasResourceLimits(r *specs.LinuxResources) bool {
+	return r != nil && (r.Memory != nil || r.CPU != nil || r.Pids != nil || r.BlockIO != nil || len(r.Devices) > 0)
+}
+
+// applyCgroups moves init, process pid, into the cgroups of m and applies
+// the resource limits of spec, returning m. Rootless containers go without
+// cgroups, and a nil manager, when they may not create them and have no
+// limits. m is left to be destroyed by the caller on error.
+func applyCgroups(m cgroupManager, spec *specs.Spec, pid int) (cgroupManager, error) {
+	var resources *specs.LinuxResources
+	if spec.Linux != nil {
+		resources = spec.Linux.Resources
+	}
+	var r specs.LinuxResources
+	if resources != nil {
+		r = *resources
+	}
+	if rootless {
+		// rootless containers may not write the devices cgroup, nor mknod
+		// devices the user may not open anyway
+		if len(r.Devices) > 0 {
+			logrus.Warnf("device rules are not supported in rootless mode, ignored")
+			r.Devices = nil
+		}
+	} else {
+		rules, err := deviceRules(spec)
+		if err != nil {
+			return nil, err
+		}
+		paths := m.Paths()
+		if _, ok := paths["devices"]; ok || len(r.Devices) > 0 {
+			r.Devices = rules
+		} else if _, ok := paths[cgroupV2Key]; !ok {
+			// the runns defaults alone do not need the devices cgroup,
+			// hosts like centos 6 may not mount it
+			logrus.Warnf("devices cgroup is not mounted, devices are not restricted")
+		}
+	}
+	resources = &r
+	if err := m.Apply(pid); err != nil {
+		if rootless && !hasResourceLimits(resources) && isPermissionError(err) {
+			m.Destroy()
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "apply cgroups")
+	}
+	if err := m.Set(resources); err != nil {
+		return nil, errors.Wrap(err, "set cgroup resources")
+	}
+	return m, nil
+}
+
+// blkio weights of the spec are in the range of cgroup v1
+const (
+	blkioWeightMin = 10
+	blkioWeightMax = 1000
+)
+
+// blockIOThrottle is a throttle list of the spec with the v1 file and the
+// io.max key of v2 setting it.
+type blockIOThrottle struct {
+	field   string
+	v1File  string
+	v2Key   string
+	devices []specs.LinuxThrottleDevice
+}
+
+func blockIOThrottles(b *specs.LinuxBlockIO) []blockIOThrottle {
+	return []blockIOThrottle{
+		{"throttleReadBpsDevice", "blkio.throttle.read_bps_device", "rbps", b.ThrottleReadBpsDevice},
+		{"throttleWriteBpsDevice", "blkio.throttle.write_bps_device", "wbps", b.ThrottleWriteBpsDevice},
+		{"throttleReadIOPSDevice", "blkio.throttle.read_iops_device", "riops", b.ThrottleReadIOPSDevice},
+		{"throttleWriteIOPSDevice", "blkio.throttle.write_iops_device", "wiops", b.ThrottleWriteIOPSDevice},
+	}
+}
+
+// validateBlockIO checks the weights of b and the devices it names before
+// any of them is written, the kernel rejects a bad entry with a bare
+// EINVAL or ENODEV.
+func validateBlockIO(b *specs.LinuxBlockIO) error {
+	if err := checkBlkioWeight("blockIO weight", b.Weight); err != nil {
+		return err
+	}
+	if err := checkBlkioWeight("blockIO leafWeight", b.LeafWeight); err != nil {
+		return err
+	}
+	for i, d := range b.WeightDevice {
+		entry := fmt.Sprintf("blockIO weightDevice[%d] %d:%d", i, d.Major, d.Minor)
+		if d.Weight == nil && d.LeafWeight == nil {
+			return errors.Errorf("%s: no weight or leafWeight", entry)
+		}
+		if err := checkBlkioWeight(entry+" weight", d.Weight); err != nil {
+			return err
+		}
+		if err := checkBlkioWeight(entry+" leafWeight", d.LeafWeight); err != nil {
+			return err
+		}
+		if err := checkBlockDevice(entry, d.Major, d.Minor); err != nil {
+			return err
+		}
+	}
+	for _, t := range blockIOThrottles(b) {
+		for i, d := range t.devices {
+			entry := fmt.Sprintf("blockIO %s[%d] %d:%d", t.field, i, d.Major, d.Minor)
+			if err := checkBlockDevice(entry, d.Major, d.Minor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkBlkioWeight(name string, weight *uint16) error {
+	if weight != nil && (*weight < blkioWeightMin || *weight > blkioWeightMax) {
+		return errors.Errorf("%s: %d is out of range %d to %d", name, *weight, blkioWeightMin, blkioWeightMax)
+	}
+	return nil
+}
+
+// checkBlockDevice makes sure major:minor is a block device of the host.
+func checkBlockDevice(entry string, major, minor int64) error {
+	if major < 0 || minor < 0 {
+		return errors.Errorf("%s: invalid device number", entry)
+	}
+	if _, err := os.Stat(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)); err != nil {
+		return errors.Errorf("%s: no such block device", entry)
+	}
+	return nil
+}
+
+func isPermissionError(err error) bool {
+	err = errors.Cause(err)
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == unix.EACCES || err == unix.EPERM || err == unix.EROFS
+}
+
+// ownCgroups returns the cgroups of runns itself by subsystem, from
+// /proc/self/cgroup. The hierarchy of cgroup v2 has the empty name.
+func ownCgroups() (map[string]string, error) {
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, errors.Wrap(err, "read /proc/self/cgroup")
+	}
+	var cgroups = make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		// hierarchy-ID:subsystems:path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			cgroups[""] = fields[2]
+			continue
+		}
+		for _, subsystem := range strings.Split(fields[1], ",") {
+			cgroups[subsystem] = fields[2]
+		}
+	}
+	return cgroups, nil
+}
+
+// cgroupDir returns the directory of cgroup path in the hierarchy mounted
+// at mountpoint, the mount showing the hierarchy from root on. A relative
+// path is below own.
+func cgroupDir(mountpoint, root, own, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(own, path)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Errorf("cgroup %s is outside the cgroup mount at %s", path, mountpoint)
+	}
+	return filepath.Join(mountpoint, rel), nil
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+		return errors.Wrapf(err, "write %q to %s", value, filepath.Join(dir, file))
+	}
+	return nil
+}
+
+func readCgroupFile(dir, file string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s", filepath.Join(dir, file))
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// removeCgroup removes the cgroup dir, retrying a while when it is busy
+// with processes on their way out.
+func removeCgroup(dir string) error {
+	var err error
+	for i := 0; i < 10; i++ {
+		err = unix.Rmdir(dir)
+		if err == nil || err == unix.ENOENT {
+			return nil
+		}
+		if err != unix.EBUSY {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.Wrapf(err, "remove cgroup %s", dir)
+}
+
+func formatInt(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
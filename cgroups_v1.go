@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// cgroupV1Subsystems are the cgroup v1 subsystems runns puts containers
+// into, the ones not mounted are skipped.
+var cgroupV1Subsystems = []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "memory", "pids"}
+
+// cgroupV1 manages the cgroups of a container in the cgroup v1
+// hierarchies, one per subsystem or a few subsystems sharing one, like
+// cpu,cpuacct.
+type cgroupV1 struct {
+	paths map[string]string
+}
+
+func newCgroupV1(path string) (*cgroupV1, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, errors.Wrap(err, "get mounts")
+	}
+	own, err := ownCgroups()
+	if err != nil {
+		return nil, err
+	}
+	c := &cgroupV1{paths: make(map[string]string)}
+	for _, m := range mounts {
+		if m.Fstype != "cgroup" {
+			continue
+		}
+		for _, opt := range strings.Split(m.VfsOpts, ",") {
+			if !IsInStringArray(opt, cgroupV1Subsystems) || c.paths[opt] != "" {
+				continue
+			}
+			dir, err := cgroupDir(m.Mountpoint, m.Root, own[opt], path)
+			if err != nil {
+				return nil, err
+			}
+			c.paths[opt] = dir
+		}
+	}
+	return c, nil
+}
+
+func (c *cgroupV1) Paths() map[string]string {
+	return c.paths
+}
+
+// dirs returns the cgroup directories, subsystems mounted together share
+// one.
+func (c *cgroupV1) dirs() []string {
+	var dirs []string
+	for _, dir := range c.paths {
+		if !IsInStringArray(dir, dirs) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func (c *cgroupV1) Apply(pid int) error {
+	for _, dir := range c.dirs() {
+		var err error
+		if dir == c.paths["cpuset"] {
+			err = mkdirCpuset(dir)
+		} else {
+			err = os.MkdirAll(dir, 0755)
+		}
+		if err != nil {
+			return errors.Wrap(err, "create cgroup")
+		}
+		if err := joinCgroupV1(dir, pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdirCpuset creates the cpuset cgroup dir like os.MkdirAll. A new
+// cpuset cgroup has no cpus and mems, and no process may join it before it
+// gets some: the ones of the parent are copied into every cgroup created.
+func mkdirCpuset(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return copyCpusetFromParent(dir)
+	}
+	if err := mkdirCpuset(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return copyCpusetFromParent(dir)
+}
+
+// copyCpusetFromParent sets the cpus and mems of dir left empty to the
+// ones of its parent.
+func copyCpusetFromParent(dir string) error {
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		value, err := readCgroupFile(dir, file)
+		if err != nil {
+			// not a cpuset cgroup, e.g. the mount point's parent
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		if value != "" {
+			continue
+		}
+		parent, err := readCgroupFile(filepath.Dir(dir), file)
+		if err != nil {
+			return err
+		}
+		if err := writeCgroupFile(dir, file, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinCgroupV1 moves every thread of process pid into the cgroup dir.
+// Kernels before 2.6.39 take single threads only, by the tasks file.
+func joinCgroupV1(dir string, pid int) error {
+	if writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid)) == nil {
+		return nil
+	}
+	tasks, err := ioutil.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return errors.Wrapf(err, "list threads of %d", pid)
+	}
+	for _, task := range tasks {
+		if err := writeCgroupFile(dir, "tasks", task.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV1) Set(r *specs.LinuxResources) error {
+	if err := c.setMemory(r.Memory); err != nil {
+		return err
+	}
+	if err := c.setCPU(r.CPU); err != nil {
+		return err
+	}
+	if err := c.setCpuset(r.CPU); err != nil {
+		return err
+	}
+	if err := c.setBlockIO(r.BlockIO); err != nil {
+		return err
+	}
+	if err := c.setDevices(r.Devices); err != nil {
+		return err
+	}
+	return c.setPids(r.Pids)
+}
+
+// path returns the cgroup of subsystem, which resources need.
+func (c *cgroupV1) path(subsystem string) (string, error) {
+	dir := c.paths[subsystem]
+	if dir == "" {
+		return "", errors.Errorf("%s cgroup is not mounted", subsystem)
+	}
+	return dir, nil
+}
+
+func (c *cgroupV1) setMemory(m *specs.LinuxMemory) error {
+	if m == nil || (m.Limit == nil && m.Reservation == nil && m.Swap == nil) {
+		return nil
+	}
+	dir, err := c.path("memory")
+	if err != nil {
+		return err
+	}
+	// Swap limits memory plus swap and may not be below the memory limit:
+	// the order to write them depends on the limits set before
+	swapDone := false
+	if m.Limit != nil {
+		if err := writeCgroupFile(dir, "memory.limit_in_bytes", formatInt(*m.Limit)); err != nil {
+			if m.Swap == nil {
+				return err
+			}
+			if err := c.setMemorySwap(dir, *m.Swap); err != nil {
+				return err
+			}
+			swapDone = true
+			if err := writeCgroupFile(dir, "memory.limit_in_bytes", formatInt(*m.Limit)); err != nil {
+				return err
+			}
+		}
+	}
+	if m.Swap != nil && !swapDone {
+		if err := c.setMemorySwap(dir, *m.Swap); err != nil {
+			return err
+		}
+	}
+	if m.Reservation != nil {
+		if err := writeCgroupFile(dir, "memory.soft_limit_in_bytes", formatInt(*m.Reservation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV1) setMemorySwap(dir string, swap int64) error {
+	if _, err := os.Stat(filepath.Join(dir, "memory.memsw.limit_in_bytes")); os.IsNotExist(err) {
+		return errors.New("memory swap limit is not supported, swap accounting is disabled in the kernel")
+	}
+	return writeCgroupFile(dir, "memory.memsw.limit_in_bytes", formatInt(swap))
+}
+
+func (c *cgroupV1) setCPU(cpu *specs.LinuxCPU) error {
+	if cpu == nil || (cpu.Shares == nil && cpu.Quota == nil && cpu.Period == nil) {
+		return nil
+	}
+	dir, err := c.path("cpu")
+	if err != nil {
+		return err
+	}
+	if cpu.Shares != nil {
+		if err := writeCgroupFile(dir, "cpu.shares", formatUint(*cpu.Shares)); err != nil {
+			return err
+		}
+	}
+	// the period first, the quota is checked against it
+	if cpu.Period != nil {
+		if err := writeCgroupFile(dir, "cpu.cfs_period_us", formatUint(*cpu.Period)); err != nil {
+			return err
+		}
+	}
+	if cpu.Quota != nil {
+		if err := writeCgroupFile(dir, "cpu.cfs_quota_us", formatInt(*cpu.Quota)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV1) setCpuset(cpu *specs.LinuxCPU) error {
+	if cpu == nil || (cpu.Cpus == "" && cpu.Mems == "") {
+		return nil
+	}
+	dir, err := c.path("cpuset")
+	if err != nil {
+		return err
+	}
+	if cpu.Cpus != "" {
+		if err := writeCgroupFile(dir, "cpuset.cpus", cpu.Cpus); err != nil {
+			return err
+		}
+	}
+	if cpu.Mems != "" {
+		if err := writeCgroupFile(dir, "cpuset.mems", cpu.Mems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBlockIO sets the weights, with the CFQ io scheduler, or the BFQ one
+// of newer kernels, and the throttles of the blkio cgroup.
+func (c *cgroupV1) setBlockIO(b *specs.LinuxBlockIO) error {
+	if b == nil {
+		return nil
+	}
+	if err := validateBlockIO(b); err != nil {
+		return err
+	}
+	dir, err := c.path("blkio")
+	if err != nil {
+		return err
+	}
+	if b.Weight != nil || b.LeafWeight != nil || len(b.WeightDevice) > 0 {
+		prefix := "blkio."
+		if _, err := os.Stat(filepath.Join(dir, "blkio.weight")); os.IsNotExist(err) {
+			prefix = "blkio.bfq."
+			if _, err := os.Stat(filepath.Join(dir, "blkio.bfq.weight")); os.IsNotExist(err) {
+				return errors.New("blkio weight is not supported, it needs the CFQ or BFQ io scheduler")
+			}
+		}
+		if b.Weight != nil {
+			if err := writeCgroupFile(dir, prefix+"weight", formatUint(uint64(*b.Weight))); err != nil {
+				return err
+			}
+		}
+		if b.LeafWeight != nil {
+			if err := writeCgroupFile(dir, prefix+"leaf_weight", formatUint(uint64(*b.LeafWeight))); err != nil {
+				return err
+			}
+		}
+		for _, d := range b.WeightDevice {
+			if d.Weight != nil {
+				if err := writeCgroupFile(dir, prefix+"weight_device", fmt.Sprintf("%d:%d %d", d.Major, d.Minor, *d.Weight)); err != nil {
+					return err
+				}
+			}
+			if d.LeafWeight != nil {
+				if err := writeCgroupFile(dir, prefix+"leaf_weight_device", fmt.Sprintf("%d:%d %d", d.Major, d.Minor, *d.LeafWeight)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, t := range blockIOThrottles(b) {
+		// a rate of 0 removes the throttle
+		for _, d := range t.devices {
+			if err := writeCgroupFile(dir, t.v1File, fmt.Sprintf("%d:%d %d", d.Major, d.Minor, d.Rate)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setDevices denies every device, then applies rules in order. nil rules
+// leave the devices cgroup as it is.
+func (c *cgroupV1) setDevices(rules []specs.LinuxDeviceCgroup) error {
+	if rules == nil {
+		return nil
+	}
+	dir, err := c.path("devices")
+	if err != nil {
+		return err
+	}
+	if err := writeCgroupFile(dir, "devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		file := "devices.deny"
+		if rule.Allow {
+			file = "devices.allow"
+		}
+		if err := writeCgroupFile(dir, file, formatDeviceRule(rule)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV1) setPids(pids *specs.LinuxPids) error {
+	if pids == nil {
+		return nil
+	}
+	dir, err := c.path("pids")
+	if err != nil {
+		return err
+	}
+	limit := "max"
+	if pids.Limit > 0 {
+		limit = formatInt(pids.Limit)
+	}
+	return writeCgroupFile(dir, "pids.max", limit)
+}
+
+func (c *cgroupV1) Destroy() error {
+	for _, dir := range c.dirs() {
+		if err := removeCgroup(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
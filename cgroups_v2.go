@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// cgroupV2Controllers are the controllers runns enables for containers in
+// the unified hierarchy.
+var cgroupV2Controllers = []string{"cpu", "cpuset", "io", "memory", "pids"}
+
+// cgroupV2Key is the key of the unified hierarchy in the cgroup paths of
+// the state.
+const cgroupV2Key = "unified"
+
+// cgroupV2 manages the cgroup of a container in the cgroup v2 unified
+// hierarchy mounted at cgroupRoot.
+type cgroupV2 struct {
+	dir string
+}
+
+func newCgroupV2(path string) (*cgroupV2, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, errors.Wrap(err, "get mounts")
+	}
+	root := "/"
+	for _, m := range mounts {
+		if m.Mountpoint == cgroupRoot {
+			root = m.Root
+		}
+	}
+	own, err := ownCgroups()
+	if err != nil {
+		return nil, err
+	}
+	// a relative path is next to the cgroup of runns, not below: a cgroup
+	// with processes in it, like the one of runns, may not enable
+	// controllers for its children
+	dir, err := cgroupDir(cgroupRoot, root, filepath.Dir(own[""]), path)
+	if err != nil {
+		return nil, err
+	}
+	return &cgroupV2{dir: dir}, nil
+}
+
+func (c *cgroupV2) Paths() map[string]string {
+	return map[string]string{cgroupV2Key: c.dir}
+}
+
+// Apply creates the cgroup, enabling the controllers along the way down
+// from the root, and moves pid into it.
+func (c *cgroupV2) Apply(pid int) error {
+	rel, err := filepath.Rel(cgroupRoot, c.dir)
+	if err != nil {
+		return err
+	}
+	parent := cgroupRoot
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if err := enableControllers(parent); err != nil {
+			return err
+		}
+		parent = filepath.Join(parent, elem)
+		if err := os.Mkdir(parent, 0755); err != nil && !os.IsExist(err) {
+			return errors.Wrap(err, "create cgroup")
+		}
+	}
+	return writeCgroupFile(c.dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// enableControllers enables the controllers of cgroupV2Controllers dir has
+// for the children of dir. The ones which can not be enabled are left out,
+// setting a resource of theirs fails later.
+func enableControllers(dir string) error {
+	content, err := readCgroupFile(dir, "cgroup.controllers")
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, controller := range strings.Fields(content) {
+		if IsInStringArray(controller, cgroupV2Controllers) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	if writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")) == nil {
+		return nil
+	}
+	for _, controller := range enable {
+		writeCgroupFile(dir, "cgroup.subtree_control", controller)
+	}
+	return nil
+}
+
+// write writes a control file of controller, failing clearly when the
+// controller is not enabled for the cgroup.
+func (c *cgroupV2) write(controller, file, value string) error {
+	if _, err := os.Stat(filepath.Join(c.dir, file)); os.IsNotExist(err) {
+		return errors.Errorf("cgroup v2 controller %s is not available for %s", controller, c.dir)
+	}
+	return writeCgroupFile(c.dir, file, value)
+}
+
+func (c *cgroupV2) Set(r *specs.LinuxResources) error {
+	if err := c.setMemory(r.Memory); err != nil {
+		return err
+	}
+	if err := c.setCPU(r.CPU); err != nil {
+		return err
+	}
+	if err := c.setCpuset(r.CPU); err != nil {
+		return err
+	}
+	if err := c.setBlockIO(r.BlockIO); err != nil {
+		return err
+	}
+	// cgroup v2 has no devices controller, device access is controlled by
+	// eBPF programs attached to the cgroup, which runns does not do. Warn
+	// when the rules deny more than the deny all most specs start with.
+	for _, rule := range r.Devices {
+		if !rule.Allow && !isDenyAllRule(rule) {
+			logrus.Warnf("device rules are not supported with cgroup v2, devices are not restricted")
+			break
+		}
+	}
+	return c.setPids(r.Pids)
+}
+
+// formatV2Limit formats limits of cgroup v2 where -1 is unlimited.
+func formatV2Limit(v int64) string {
+	if v < 0 {
+		return "max"
+	}
+	return formatInt(v)
+}
+
+func (c *cgroupV2) setMemory(m *specs.LinuxMemory) error {
+	if m == nil {
+		return nil
+	}
+	if m.Swap != nil {
+		// the spec limits memory plus swap like v1, v2 limits swap alone
+		swap := "max"
+		if *m.Swap >= 0 {
+			if m.Limit == nil || *m.Limit < 0 {
+				return errors.New("memory swap limit needs a memory limit in cgroup v2")
+			}
+			if *m.Swap < *m.Limit {
+				return errors.Errorf("memory swap limit %d is below the memory limit %d", *m.Swap, *m.Limit)
+			}
+			swap = formatInt(*m.Swap - *m.Limit)
+		}
+		if err := c.write("memory", "memory.swap.max", swap); err != nil {
+			return err
+		}
+	}
+	if m.Limit != nil {
+		if err := c.write("memory", "memory.max", formatV2Limit(*m.Limit)); err != nil {
+			return err
+		}
+	}
+	if m.Reservation != nil {
+		if err := c.write("memory", "memory.low", formatV2Limit(*m.Reservation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cpuSharesToWeight converts cpu shares of v1, 2 to 262144, to the cpu
+// weight of v2, 1 to 10000.
+func cpuSharesToWeight(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func (c *cgroupV2) setCPU(cpu *specs.LinuxCPU) error {
+	if cpu == nil {
+		return nil
+	}
+	if cpu.Shares != nil {
+		if err := c.write("cpu", "cpu.weight", formatUint(cpuSharesToWeight(*cpu.Shares))); err != nil {
+			return err
+		}
+	}
+	if cpu.Quota != nil || cpu.Period != nil {
+		quota := "max"
+		if cpu.Quota != nil && *cpu.Quota > 0 {
+			quota = formatInt(*cpu.Quota)
+		}
+		var period uint64 = 100000
+		if cpu.Period != nil {
+			period = *cpu.Period
+		}
+		if err := c.write("cpu", "cpu.max", quota+" "+formatUint(period)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCpuset sets the cpus and mems of the cgroup, a cgroup v2 left empty
+// uses the ones of its parent.
+func (c *cgroupV2) setCpuset(cpu *specs.LinuxCPU) error {
+	if cpu == nil {
+		return nil
+	}
+	if cpu.Cpus != "" {
+		if err := c.write("cpuset", "cpuset.cpus", cpu.Cpus); err != nil {
+			return err
+		}
+	}
+	if cpu.Mems != "" {
+		if err := c.write("cpuset", "cpuset.mems", cpu.Mems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blkioWeightToIOWeight converts a blkio weight of v1, 10 to 1000, to the
+// io weight of v2, 1 to 10000.
+func blkioWeightToIOWeight(weight uint16) uint64 {
+	return 1 + (uint64(weight)-blkioWeightMin)*9999/(blkioWeightMax-blkioWeightMin)
+}
+
+// setBlockIO sets io.weight and io.max. Without io.weight the cgroup may
+// have io.bfq.weight of the BFQ io scheduler, which takes the weights of v1
+// as they are. cgroup v2 has no leaf weights.
+func (c *cgroupV2) setBlockIO(b *specs.LinuxBlockIO) error {
+	if b == nil {
+		return nil
+	}
+	if err := validateBlockIO(b); err != nil {
+		return err
+	}
+	if b.LeafWeight != nil {
+		logrus.Warnf("blockIO leafWeight is not supported by cgroup v2, ignored")
+	}
+	if b.Weight != nil || len(b.WeightDevice) > 0 {
+		file := "io.weight"
+		convert := blkioWeightToIOWeight
+		if _, err := os.Stat(filepath.Join(c.dir, file)); os.IsNotExist(err) {
+			file = "io.bfq.weight"
+			convert = func(weight uint16) uint64 { return uint64(weight) }
+		}
+		if b.Weight != nil {
+			if err := c.write("io", file, "default "+formatUint(convert(*b.Weight))); err != nil {
+				return err
+			}
+		}
+		for _, d := range b.WeightDevice {
+			if d.LeafWeight != nil {
+				logrus.Warnf("blockIO leafWeight of %d:%d is not supported by cgroup v2, ignored", d.Major, d.Minor)
+			}
+			if d.Weight == nil {
+				continue
+			}
+			if err := c.write("io", file, fmt.Sprintf("%d:%d %d", d.Major, d.Minor, convert(*d.Weight))); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range blockIOThrottles(b) {
+		for _, d := range t.devices {
+			rate := "max"
+			if d.Rate > 0 {
+				rate = formatUint(d.Rate)
+			}
+			if err := c.write("io", "io.max", fmt.Sprintf("%d:%d %s=%s", d.Major, d.Minor, t.v2Key, rate)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV2) setPids(pids *specs.LinuxPids) error {
+	if pids == nil {
+		return nil
+	}
+	limit := "max"
+	if pids.Limit > 0 {
+		limit = formatInt(pids.Limit)
+	}
+	return c.write("pids", "pids.max", limit)
+}
+
+func (c *cgroupV2) Destroy() error {
+	return removeCgroup(c.dir)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// command is a runns subcommand, a trimmed down version of urfave/cli's
+// which runc is built on.
+type command struct {
+	Name      string
+	ArgsUsage string
+	Usage     string
+	// Hidden commands are for runns internal use and not in the help.
+	Hidden bool
+	// Flags registers the flags of the command.
+	Flags func(fs *flag.FlagSet)
+	// MinArgs and MaxArgs bound the number of arguments, MaxArgs -1 is
+	// unlimited.
+	MinArgs int
+	MaxArgs int
+	Action  func(ctx *context) error
+}
+
+// context is handed to the action of a command.
+type context struct {
+	cmd *command
+	fs  *flag.FlagSet
+}
+
+func (c *context) Args() []string {
+	return c.fs.Args()
+}
+
+func (c *context) Bool(name string) bool {
+	return c.fs.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+func (c *context) String(name string) string {
+	return c.fs.Lookup(name).Value.String()
+}
+
+// IsSet tells whether flag name was given on the command line.
+func (c *context) IsSet(name string) bool {
+	var set bool
+	c.fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// boolFlag and stringFlag register a flag under every comma separated name,
+// e.g. "detach, d".
+func boolFlag(fs *flag.FlagSet, names string, value bool, usage string) {
+	p := new(bool)
+	for _, name := range strings.Split(names, ",") {
+		fs.BoolVar(p, strings.TrimSpace(name), value, usage)
+	}
+	*p = value
+}
+
+func stringFlag(fs *flag.FlagSet, names string, value string, usage string) {
+	p := new(string)
+	for _, name := range strings.Split(names, ",") {
+		fs.StringVar(p, strings.TrimSpace(name), value, usage)
+	}
+	*p = value
+}
+
+// printFlags prints the flags of fs, one line for all names of a flag.
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	var names = make(map[string][]string)
+	var defaults = make(map[string]string)
+	var order []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := names[f.Usage]; !ok {
+			order = append(order, f.Usage)
+		}
+		if f.DefValue != "" && f.DefValue != "false" {
+			defaults[f.Usage] = fmt.Sprintf(" (default: %q)", f.DefValue)
+		}
+		prefix := "--"
+		if len(f.Name) == 1 {
+			prefix = "-"
+		}
+		names[f.Usage] = append(names[f.Usage], prefix+f.Name)
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, usage := range order {
+		fmt.Fprintf(tw, "   %s\t%s%s\n", strings.Join(names[usage], ", "), usage, defaults[usage])
+	}
+	tw.Flush()
+}
+
+func (c *command) newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if c.Flags != nil {
+		c.Flags(fs)
+	}
+	return fs
+}
+
+func (c *command) printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: runns %s [command options] %s\n\n%s\n", c.Name, c.ArgsUsage, c.Usage)
+	fs := c.newFlagSet()
+	var hasFlags bool
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintf(w, "\nOptions:\n")
+		printFlags(w, fs)
+	}
+}
+
+// parse parses args allowing flags after the positional arguments, like
+// `runns delete foo --force`. Everything after "--" is an argument.
+func (c *command) parse(fs *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		if args[0] == "--" {
+			positional = append(positional, args[1:]...)
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return fs.Parse(append([]string{"--"}, positional...))
+}
+
+func (c *command) run(args []string) error {
+	fs := c.newFlagSet()
+	if err := c.parse(fs, args); err != nil {
+		if err == flag.ErrHelp {
+			c.printUsage(os.Stdout)
+			return nil
+		}
+		return errors.Errorf("%s: %v", c.Name, err)
+	}
+	if n := fs.NArg(); n < c.MinArgs || (c.MaxArgs >= 0 && n > c.MaxArgs) {
+		return errors.Errorf("%s: wrong number of arguments, see 'runns %s --help'", c.Name, c.Name)
+	}
+	return c.Action(&context{cmd: c, fs: fs})
+}
+
+// app is the runns command line: global flags followed by a command.
+type app struct {
+	Usage    string
+	Flags    func(fs *flag.FlagSet)
+	Before   func(ctx *context) error
+	Commands []*command
+}
+
+func (a *app) printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: runns [global options] command [command options] [arguments...]\n\n%s\n\nCommands:\n", a.Usage)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range a.Commands {
+		if !c.Hidden {
+			fmt.Fprintf(tw, "   %s\t%s\n", c.Name, c.Usage)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nGlobal options:\n")
+	fs := flag.NewFlagSet("runns", flag.ContinueOnError)
+	a.Flags(fs)
+	printFlags(w, fs)
+}
+
+func (a *app) run(args []string) error {
+	fs := flag.NewFlagSet("runns", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	a.Flags(fs)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			a.printUsage(os.Stdout)
+			return nil
+		}
+		return err
+	}
+	if err := a.Before(&context{fs: fs}); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		a.printUsage(os.Stderr)
+		return errors.New("missing command")
+	}
+	name := fs.Arg(0)
+	if name == "help" {
+		if fs.NArg() > 1 {
+			for _, c := range a.Commands {
+				if c.Name == fs.Arg(1) {
+					c.printUsage(os.Stdout)
+					return nil
+				}
+			}
+		}
+		a.printUsage(os.Stdout)
+		return nil
+	}
+	for _, c := range a.Commands {
+		if c.Name == name {
+			return c.run(fs.Args()[1:])
+		}
+	}
+	return errors.Errorf("unknown command %q, see 'runns help'", name)
+}
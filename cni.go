@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultCNIConfDir = "/etc/cni/net.d"
+	defaultCNIBinDir  = "/opt/cni/bin"
+)
+
+// cniNetns is the bind mount of the network namespace of the container in
+// its directory. It keeps the namespace around for the DEL after the
+// container has exited.
+var cniNetns = "netns"
+
+// cniNetwork is a CNI network, from a single plugin config or a config
+// list.
+type cniNetwork struct {
+	Name       string                   `json:"name"`
+	CNIVersion string                   `json:"cniVersion"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// loadCNINetwork loads the first network config of dir in lexical order,
+// like the CNI tools do.
+func loadCNINetwork(dir string) (*cniNetwork, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read cni config dir")
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		switch filepath.Ext(f.Name()) {
+		case ".conflist":
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, errors.Wrap(err, "read cni config")
+			}
+			var network = new(cniNetwork)
+			if err := json.Unmarshal(content, network); err != nil {
+				return nil, errors.Wrapf(err, "parse cni config %s", path)
+			}
+			return network, network.validate(path)
+		case ".conf", ".json":
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, errors.Wrap(err, "read cni config")
+			}
+			var plugin map[string]interface{}
+			if err := json.Unmarshal(content, &plugin); err != nil {
+				return nil, errors.Wrapf(err, "parse cni config %s", path)
+			}
+			network := &cniNetwork{Plugins: []map[string]interface{}{plugin}}
+			network.Name, _ = plugin["name"].(string)
+			network.CNIVersion, _ = plugin["cniVersion"].(string)
+			return network, network.validate(path)
+		}
+	}
+	return nil, errors.Errorf("no cni network config in %s", dir)
+}
+
+func (n *cniNetwork) validate(path string) error {
+	if n.Name == "" {
+		return errors.Errorf("cni config %s has no name", path)
+	}
+	if len(n.Plugins) == 0 {
+		return errors.Errorf("cni config %s has no plugins", path)
+	}
+	for _, plugin := range n.Plugins {
+		if typ, _ := plugin["type"].(string); typ == "" {
+			return errors.Errorf("cni config %s has a plugin without type", path)
+		}
+	}
+	return nil
+}
+
+// pluginConfig returns the stdin of plugin, the network name and version
+// are the ones of the list.
+func (n *cniNetwork) pluginConfig(plugin map[string]interface{}, prevResult json.RawMessage) ([]byte, error) {
+	var conf = make(map[string]interface{}, len(plugin)+3)
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"] = n.Name
+	conf["cniVersion"] = n.CNIVersion
+	if len(prevResult) > 0 {
+		conf["prevResult"] = prevResult
+	}
+	return json.Marshal(conf)
+}
+
+// cniError is what a failing plugin prints on stdout.
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+// cniExec runs command of plugin on the network namespace at netns and
+// returns its stdout.
+func cniExec(ncName string, config *networkConfig, command, netns string, plugin map[string]interface{}, stdin []byte) ([]byte, error) {
+	typ := plugin["type"].(string)
+	path, err := findCNIPlugin(typ, config.CNIBinDir)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Env = []string{
+		"CNI_COMMAND=" + command,
+		"CNI_CONTAINERID=" + ncName,
+		"CNI_NETNS=" + netns,
+		"CNI_IFNAME=" + config.Interface,
+		"CNI_PATH=" + config.CNIBinDir,
+		// plugins run iptables and the like
+		"PATH=" + os.Getenv("PATH"),
+	}
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var e cniError
+		if json.Unmarshal(stdout.Bytes(), &e) == nil && e.Msg != "" {
+			if e.Details != "" {
+				return nil, errors.Errorf("cni plugin %s %s: %s (code %d): %s", typ, command, e.Msg, e.Code, e.Details)
+			}
+			return nil, errors.Errorf("cni plugin %s %s: %s (code %d)", typ, command, e.Msg, e.Code)
+		}
+		return nil, errors.Wrapf(err, "cni plugin %s %s: %s", typ, command, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// findCNIPlugin looks up plugin typ in the colon separated binDir.
+func findCNIPlugin(typ, binDir string) (string, error) {
+	for _, dir := range filepath.SplitList(binDir) {
+		path := filepath.Join(dir, typ)
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("cni plugin %s not found in %s", typ, binDir)
+}
+
+// cniAdd runs the ADD of the CNI network of config on the network
+// namespace of pid, keeping the network and the result in config.
+func cniAdd(ncName string, config *networkConfig, pid int) (err error) {
+	network, err := loadCNINetwork(config.CNIConfDir)
+	if err != nil {
+		return err
+	}
+	config.CNINetwork = network
+	netns := containerPath(ncName, cniNetns)
+	if err := createIfNotExists(netns, false); err != nil {
+		return errors.Wrap(err, "create netns mount point")
+	}
+	if err := unix.Mount(fmt.Sprintf("/proc/%d/ns/net", pid), netns, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrap(err, "bind mount network namespace")
+	}
+	defer func() {
+		// init is killed on failure, the DEL of teardownNetwork then runs
+		// without the namespace
+		if err != nil {
+			if rerr := releaseNetns(netns); rerr != nil {
+				logrus.Warnf("%v", rerr)
+			}
+		}
+	}()
+	var result json.RawMessage
+	for _, plugin := range network.Plugins {
+		stdin, err := network.pluginConfig(plugin, result)
+		if err != nil {
+			return errors.Wrap(err, "marshal cni config")
+		}
+		if result, err = cniExec(ncName, config, "ADD", netns, plugin, stdin); err != nil {
+			return err
+		}
+	}
+	config.CNIResult = result
+	return nil
+}
+
+// cniDel runs the DEL of the CNI network of config, plugins in reverse
+// order, and releases the network namespace. Plugins are expected to
+// clean up what they can when the namespace is gone already. A failing
+// plugin does not stop the others nor keep the namespace mounted, so the
+// container can still be deleted.
+func cniDel(ncName string, config *networkConfig) error {
+	network := config.CNINetwork
+	if network == nil {
+		// the ADD failed before the network was loaded
+		return nil
+	}
+	netns := containerPath(ncName, cniNetns)
+	if _, err := os.Stat(netns); err != nil {
+		netns = ""
+	}
+	var msgs []string
+	for i := len(network.Plugins) - 1; i >= 0; i-- {
+		stdin, err := network.pluginConfig(network.Plugins[i], config.CNIResult)
+		if err != nil {
+			err = errors.Wrap(err, "marshal cni config")
+		} else {
+			_, err = cniExec(ncName, config, "DEL", netns, network.Plugins[i], stdin)
+		}
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if netns != "" {
+		if err := releaseNetns(netns); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// releaseNetns unmounts the network namespace bind mount at netns and
+// removes the mount point.
+func releaseNetns(netns string) error {
+	if err := unix.Unmount(netns, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return errors.Wrap(err, "unmount network namespace")
+	}
+	if err := os.Remove(netns); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove network namespace mount point")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubPlugin logs its name, command and CNI_* env to log, and fails with
+// a CNI error when its config has "mode": "fail".
+const stubPlugin = `#!/bin/sh
+in=$(cat)
+echo "$(basename $0) $CNI_COMMAND $CNI_CONTAINERID [$CNI_NETNS] $CNI_IFNAME $CNI_PATH" >> "$(dirname $0)/log"
+case "$in" in *'"mode":"fail"'*) echo '{"code":7,"msg":"stub failed"}'; exit 1;; esac
+echo '{"cniVersion":"0.4.0"}'
+`
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "runns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stubCNIConfig writes the stub plugin as each of types into a temp dir
+// and returns the network config using it.
+func stubCNIConfig(t *testing.T, types ...string) *networkConfig {
+	dir := tempDir(t)
+	for _, typ := range types {
+		writeFile(t, filepath.Join(dir, typ), stubPlugin, 0755)
+	}
+	return &networkConfig{Mode: networkCNI, Interface: "eth0", CNIBinDir: dir}
+}
+
+func stubLog(t *testing.T, config *networkConfig) []string {
+	content, err := ioutil.ReadFile(filepath.Join(config.CNIBinDir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestLoadCNINetwork(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "20-list.conflist"), `{"cniVersion":"0.4.0","name":"list","plugins":[{"type":"a"},{"type":"b"}]}`, 0644)
+	writeFile(t, filepath.Join(dir, "10-single.conf"), `{"cniVersion":"0.3.1","name":"single","type":"a"}`, 0644)
+	writeFile(t, filepath.Join(dir, "00-ignored.txt"), `{}`, 0644)
+	network, err := loadCNINetwork(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.Name != "single" || network.CNIVersion != "0.3.1" || len(network.Plugins) != 1 {
+		t.Errorf("loaded %+v, want the network of 10-single.conf", network)
+	}
+
+	writeFile(t, filepath.Join(dir, "05-list.conflist"), `{"cniVersion":"0.4.0","name":"first","plugins":[{"type":"a"},{"type":"b"}]}`, 0644)
+	if network, err = loadCNINetwork(dir); err != nil {
+		t.Fatal(err)
+	}
+	if network.Name != "first" || len(network.Plugins) != 2 {
+		t.Errorf("loaded %+v, want the network of 05-list.conflist", network)
+	}
+
+	writeFile(t, filepath.Join(dir, "01-bad.conflist"), `{"cniVersion":"0.4.0","name":"bad","plugins":[{}]}`, 0644)
+	if _, err := loadCNINetwork(dir); err == nil {
+		t.Error("loadCNINetwork accepted a plugin without type")
+	}
+	if _, err := loadCNINetwork(filepath.Join(dir, "missing")); err == nil {
+		t.Error("loadCNINetwork of a missing dir succeeded")
+	}
+}
+
+func TestPluginConfig(t *testing.T) {
+	network := &cniNetwork{Name: "net", CNIVersion: "0.4.0"}
+	plugin := map[string]interface{}{"type": "a", "name": "other", "cniVersion": "0.1.0", "x": 1.0}
+	for _, prevResult := range []json.RawMessage{nil, json.RawMessage(`{"ips":[]}`)} {
+		stdin, err := network.pluginConfig(plugin, prevResult)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conf map[string]interface{}
+		if err := json.Unmarshal(stdin, &conf); err != nil {
+			t.Fatal(err)
+		}
+		if conf["name"] != "net" || conf["cniVersion"] != "0.4.0" || conf["type"] != "a" || conf["x"] != 1.0 {
+			t.Errorf("plugin config %s does not have the name and version of the network", stdin)
+		}
+		if _, ok := conf["prevResult"]; ok != (prevResult != nil) {
+			t.Errorf("plugin config %s, prevResult %s", stdin, prevResult)
+		}
+	}
+	if plugin["name"] != "other" {
+		t.Error("pluginConfig modified the plugin")
+	}
+}
+
+func TestCNIExec(t *testing.T) {
+	config := stubCNIConfig(t, "stub")
+	defer os.RemoveAll(config.CNIBinDir)
+	plugin := map[string]interface{}{"type": "stub"}
+	out, err := cniExec("nc1", config, "ADD", "/run/netns", plugin, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) != `{"cniVersion":"0.4.0"}` {
+		t.Errorf("cniExec returned %q, want the stdout of the plugin", out)
+	}
+	want := "stub ADD nc1 [/run/netns] eth0 " + config.CNIBinDir
+	if log := stubLog(t, config); log[0] != want {
+		t.Errorf("plugin ran with %q, want %q", log[0], want)
+	}
+
+	_, err = cniExec("nc1", config, "DEL", "", plugin, []byte(`{"mode":"fail"}`))
+	if err == nil || err.Error() != "cni plugin stub DEL: stub failed (code 7)" {
+		t.Errorf("cniExec of a failing plugin returned %v", err)
+	}
+	if _, err := cniExec("nc1", config, "ADD", "", map[string]interface{}{"type": "missing"}, nil); err == nil {
+		t.Error("cniExec of a missing plugin succeeded")
+	}
+}
+
+func TestCNIDel(t *testing.T) {
+	defer func(old string) { listPath = old }(listPath)
+	listPath = tempDir(t)
+	defer os.RemoveAll(listPath)
+	config := stubCNIConfig(t, "first", "second")
+	defer os.RemoveAll(config.CNIBinDir)
+	config.CNINetwork = &cniNetwork{
+		Name:       "net",
+		CNIVersion: "0.4.0",
+		Plugins: []map[string]interface{}{
+			{"type": "first", "mode": "fail"},
+			{"type": "second", "mode": "fail"},
+		},
+	}
+	err := cniDel("nc1", config)
+	if err == nil || strings.Count(err.Error(), "stub failed") != 2 {
+		t.Errorf("cniDel returned %v, want the errors of both plugins", err)
+	}
+	log := stubLog(t, config)
+	if len(log) != 2 || !strings.HasPrefix(log[0], "second DEL nc1 [] ") || !strings.HasPrefix(log[1], "first DEL nc1 [] ") {
+		t.Errorf("plugins ran as %q, want the DEL of second then first", log)
+	}
+}
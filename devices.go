@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// containerDevices returns the device nodes to create in the container,
+// the ones of linux.devices and the default ones of runc: null, zero,
+// full, tty, random and urandom. linux.devices overrides a default device
+// of the same path.
+func containerDevices(spec *specs.Spec) ([]*configs.Device, error) {
+	var devices []*configs.Device
+	var paths []string
+	if spec.Linux != nil {
+		for i, d := range spec.Linux.Devices {
+			device, err := convertDevice(d)
+			if err != nil {
+				return nil, errors.Wrapf(err, "linux.devices[%d] %s", i, d.Path)
+			}
+			devices = append(devices, device)
+			paths = append(paths, device.Path)
+		}
+	}
+	for _, d := range configs.DefaultSimpleDevices {
+		if !IsInStringArray(d.Path, paths) {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func convertDevice(d specs.LinuxDevice) (*configs.Device, error) {
+	if !filepath.IsAbs(d.Path) {
+		return nil, errors.New("path is not absolute")
+	}
+	if len(d.Type) != 1 || !strings.Contains("cbup", d.Type) {
+		return nil, errors.Errorf("invalid type %q, expect c, b, u or p", d.Type)
+	}
+	if d.Type != "p" && (d.Major < 0 || d.Minor < 0) {
+		return nil, errors.Errorf("invalid device number %d:%d", d.Major, d.Minor)
+	}
+	device := &configs.Device{
+		Type:        rune(d.Type[0]),
+		Path:        CleanPath(d.Path),
+		Major:       d.Major,
+		Minor:       d.Minor,
+		Permissions: "rwm",
+		FileMode:    0666,
+	}
+	if d.FileMode != nil {
+		device.FileMode = *d.FileMode
+	}
+	if d.UID != nil {
+		device.Uid = *d.UID
+	}
+	if d.GID != nil {
+		device.Gid = *d.GID
+	}
+	return device, nil
+}
+
+// createDevices creates the device nodes of config in the rootfs. Where
+// mknod is not permitted, in a user namespace, the device of the host is
+// bind mounted instead. Nodes already in the rootfs are left alone, like
+// runc does.
+func createDevices(config *configs.Config) error {
+	// the file modes of the devices are not subject to the umask
+	oldMask := unix.Umask(0)
+	defer unix.Umask(oldMask)
+	for _, d := range config.Devices {
+		// a symlink in the rootfs must not lead out of it, the rootfs is
+		// not the root yet
+		dest, err := FollowSymlinkInScope(filepath.Join(config.Rootfs, d.Path), config.Rootfs)
+		if err != nil {
+			return errors.Wrapf(err, "resolve device %s", d.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return errors.Wrapf(err, "create parent of device %s", d.Path)
+		}
+		err = mknodDevice(dest, d)
+		if os.IsExist(err) {
+			continue
+		}
+		if err == unix.EPERM {
+			err = bindDevice(dest, d)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "create device %s", d.Path)
+		}
+	}
+	return nil
+}
+
+func mknodDevice(dest string, d *configs.Device) error {
+	var mode uint32
+	switch d.Type {
+	case 'c', 'u':
+		mode = unix.S_IFCHR
+	case 'b':
+		mode = unix.S_IFBLK
+	case 'p':
+		mode = unix.S_IFIFO
+	}
+	dev := unix.Mkdev(uint32(d.Major), uint32(d.Minor))
+	if err := unix.Mknod(dest, mode|uint32(d.FileMode.Perm()), int(dev)); err != nil {
+		if err == unix.EEXIST {
+			return os.ErrExist
+		}
+		return err
+	}
+	return unix.Chown(dest, int(d.Uid), int(d.Gid))
+}
+
+func bindDevice(dest string, d *configs.Device) error {
+	if err := createIfNotExists(dest, false); err != nil {
+		return err
+	}
+	return unix.Mount(d.Path, dest, "bind", unix.MS_BIND, "")
+}
+
+// deviceRules returns the rules of the devices cgroup: the ones of
+// linux.resources.devices, then the devices runc always allows and the
+// devices created in the container. The list is never nil, so the devices
+// cgroup denies everything else even for a spec without rules.
+func deviceRules(spec *specs.Spec) ([]specs.LinuxDeviceCgroup, error) {
+	var rules = []specs.LinuxDeviceCgroup{}
+	if spec.Linux != nil && spec.Linux.Resources != nil {
+		for i, rule := range spec.Linux.Resources.Devices {
+			if err := validateDeviceRule(rule); err != nil {
+				return nil, errors.Wrapf(err, "linux.resources.devices[%d]", i)
+			}
+			rules = append(rules, rule)
+		}
+	}
+	devices, err := containerDevices(spec)
+	if err != nil {
+		return nil, err
+	}
+	allowed := append([]*configs.Device{}, configs.DefaultAllowedDevices...)
+	for _, d := range append(allowed, devices...) {
+		if d.Type == 'p' {
+			continue
+		}
+		rule := specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   string(d.Type),
+			Access: d.Permissions,
+		}
+		if d.Type == 'u' {
+			rule.Type = "c"
+		}
+		if d.Major != configs.Wildcard {
+			rule.Major = &d.Major
+		}
+		if d.Minor != configs.Wildcard {
+			rule.Minor = &d.Minor
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// isDenyAllRule tells whether rule denies any access to every device.
+func isDenyAllRule(rule specs.LinuxDeviceCgroup) bool {
+	return !rule.Allow && formatDeviceRule(rule) == "a *:* rwm"
+}
+
+func validateDeviceRule(rule specs.LinuxDeviceCgroup) error {
+	if rule.Type != "" && rule.Type != "a" && rule.Type != "b" && rule.Type != "c" {
+		return errors.Errorf("invalid type %q, expect a, b or c", rule.Type)
+	}
+	if strings.Trim(rule.Access, "rwm") != "" {
+		return errors.Errorf("invalid access %q, expect some of rwm", rule.Access)
+	}
+	return nil
+}
+
+// formatDeviceRule formats rule for devices.allow and devices.deny of the
+// devices cgroup, type major:minor access with * for any.
+func formatDeviceRule(rule specs.LinuxDeviceCgroup) string {
+	typ, major, minor, access := "a", "*", "*", "rwm"
+	if rule.Type != "" {
+		typ = rule.Type
+	}
+	if rule.Major != nil && *rule.Major != configs.Wildcard {
+		major = fmt.Sprint(*rule.Major)
+	}
+	if rule.Minor != nil && *rule.Minor != configs.Wildcard {
+		minor = fmt.Sprint(*rule.Minor)
+	}
+	if rule.Access != "" {
+		access = rule.Access
+	}
+	return fmt.Sprintf("%s %s:%s %s", typ, major, minor, access)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func int64p(v int64) *int64 {
+	return &v
+}
+
+func TestFormatDeviceRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule specs.LinuxDeviceCgroup
+		want string
+	}{
+		{specs.LinuxDeviceCgroup{}, "a *:* rwm"},
+		{specs.LinuxDeviceCgroup{Type: "c", Major: int64p(1), Minor: int64p(3), Access: "rw"}, "c 1:3 rw"},
+		{specs.LinuxDeviceCgroup{Type: "b", Major: int64p(8), Minor: int64p(-1), Access: "m"}, "b 8:* m"},
+		{specs.LinuxDeviceCgroup{Type: "c", Minor: int64p(0)}, "c *:0 rwm"},
+	} {
+		if got := formatDeviceRule(tc.rule); got != tc.want {
+			t.Errorf("formatDeviceRule(%+v) = %q, want %q", tc.rule, got, tc.want)
+		}
+	}
+}
+
+func TestIsDenyAllRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule specs.LinuxDeviceCgroup
+		want bool
+	}{
+		{specs.LinuxDeviceCgroup{Access: "rwm"}, true},
+		{specs.LinuxDeviceCgroup{Type: "a"}, true},
+		{specs.LinuxDeviceCgroup{Allow: true, Access: "rwm"}, false},
+		{specs.LinuxDeviceCgroup{Access: "w"}, false},
+		{specs.LinuxDeviceCgroup{Type: "c", Major: int64p(1), Minor: int64p(3), Access: "rwm"}, false},
+	} {
+		if got := isDenyAllRule(tc.rule); got != tc.want {
+			t.Errorf("isDenyAllRule(%+v) = %v, want %v", tc.rule, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceRules(t *testing.T) {
+	deny := specs.LinuxDeviceCgroup{Access: "rwm"}
+	spec := &specs.Spec{Linux: &specs.Linux{
+		Devices:   []specs.LinuxDevice{{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229}},
+		Resources: &specs.LinuxResources{Devices: []specs.LinuxDeviceCgroup{deny}},
+	}}
+	rules, err := deviceRules(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) == 0 || formatDeviceRule(rules[0]) != "a *:* rwm" || rules[0].Allow {
+		t.Fatalf("first rule is not the one of the spec: %+v", rules)
+	}
+	var formatted []string
+	for _, rule := range rules[1:] {
+		if !rule.Allow {
+			t.Errorf("default rule %q denies", formatDeviceRule(rule))
+		}
+		formatted = append(formatted, formatDeviceRule(rule))
+	}
+	for _, want := range []string{"c 1:3 rwm", "c 1:9 rwm", "c 5:0 rwm", "c 10:229 rwm"} {
+		if !IsInStringArray(want, formatted) {
+			t.Errorf("rules %v do not allow %q", formatted, want)
+		}
+	}
+
+	if rules, err := deviceRules(&specs.Spec{}); err != nil || rules == nil {
+		t.Errorf("deviceRules of an empty spec = %v, %v, want default rules", rules, err)
+	}
+
+	spec.Linux.Resources.Devices = []specs.LinuxDeviceCgroup{{Type: "x"}}
+	if _, err := deviceRules(spec); err == nil {
+		t.Error("deviceRules accepted type x")
+	}
+	spec.Linux.Resources.Devices = []specs.LinuxDeviceCgroup{{Access: "rwx"}}
+	if _, err := deviceRules(spec); err == nil {
+		t.Error("deviceRules accepted access rwx")
+	}
+}
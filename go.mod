@@ -5,7 +5,7 @@ replace github.com/Sirupsen/logrus v1.4.2 => github.com/sirupsen/logrus v1.4.2
 go 1.12
 
 require (
-	github.com/Sirupsen/logrus v1.4.2 // indirect
+	github.com/Sirupsen/logrus v1.4.2
 	github.com/docker/docker v1.13.1
 	github.com/mrunalp/fileutils v0.0.0-20171103030105-7d4729fb3618
 	github.com/opencontainers/runc v0.1.1
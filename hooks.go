@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// runHook runs hook with the OCI state of the container on its stdin, as
+// the runtime spec requires.
+func runHook(hook specs.Hook, state *specs.State) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "marshal state")
+	}
+	var stderr bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:   hook.Path,
+		Args:   hook.Args,
+		Env:    hook.Env,
+		Stdin:  bytes.NewReader(stateBytes),
+		Stderr: &stderr,
+	}
+	if len(cmd.Args) == 0 {
+		cmd.Args = []string{hook.Path}
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start hook %s", hook.Path)
+	}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- cmd.Wait()
+	}()
+	var timeout <-chan time.Time
+	if hook.Timeout != nil {
+		timeout = time.After(time.Duration(*hook.Timeout) * time.Second)
+	}
+	select {
+	case err := <-errC:
+		if err != nil {
+			return errors.Wrapf(err, "hook %s: %s", hook.Path, stderr.String())
+		}
+		return nil
+	case <-timeout:
+		cmd.Process.Kill()
+		<-errC
+		return errors.Errorf("hook %s ran more than %ds", hook.Path, *hook.Timeout)
+	}
+}
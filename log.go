@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// logFile tells whether logs go to the --log file rather than stderr.
+var logFile bool
+
+// logArgs are the global flags passing the log settings on to the child.
+var logArgs []string
+
+// setupLog points logrus at path, stderr by default, with the text or
+// JSON formatter like runc.
+func setupLog(path, format string) error {
+	logArgs = []string{"--log-format", format}
+	switch format {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unknown log-format %q, expect text or json", format)
+	}
+	if path != "" {
+		// the child opens it again
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrap(err, "log file path")
+		}
+		logArgs = append(logArgs, "--log", abs)
+		f, err := os.OpenFile(abs, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_SYNC, 0644)
+		if err != nil {
+			return errors.Wrap(err, "open log file")
+		}
+		logrus.SetOutput(f)
+		logFile = true
+	}
+	return nil
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
@@ -18,157 +23,579 @@ import (
 var specConfig = "config.json"
 var listPath = "/run/runns"
 
-func ncExist(ncName string) (bool, error) {
-	files, err := ioutil.ReadDir(listPath)
+// listPathErr is why there is no listPath, a rootless user without
+// XDG_RUNTIME_DIR has none. Only the commands using the state fail on it,
+// see checkListPath.
+var listPathErr error
+
+// exec fifo kept in the per container directory under listPath
+var execFifo = "exec.fifo"
+
+var runnsApp = &app{
+	Usage: "Simplified runc for centos6 or lower, runs OCI bundles with a config.json and rootfs.",
+	Flags: func(fs *flag.FlagSet) {
+		stringFlag(fs, "root", "/run/runns", "root directory for storage of container state")
+		stringFlag(fs, "log", "", "log file path, logs go to stderr by default")
+		stringFlag(fs, "log-format", "text", "log format, text or json")
+		stringFlag(fs, "rootless", "auto", "run unprivileged in a user namespace: true, false or auto for users but root")
+	},
+	Before: func(ctx *context) error {
+		var err error
+		if rootless, err = parseRootless(ctx.String("rootless")); err != nil {
+			return err
+		}
+		root := ctx.String("root")
+		if rootless && !ctx.IsSet("root") {
+			root, listPathErr = rootlessStateDir()
+		}
+		if listPathErr == nil {
+			if root, err = filepath.Abs(root); err != nil {
+				return err
+			}
+			listPath = root
+		}
+		return setupLog(ctx.String("log"), ctx.String("log-format"))
+	},
+	Commands: []*command{
+		createCommand,
+		startCommand,
+		runCommand,
+		killCommand,
+		deleteCommand,
+		listCommand,
+		stateCommand,
+		updateCommand,
+		childCommand,
+	},
+}
+
+func main() {
+	err := runnsApp.run(os.Args[1:])
 	if err != nil {
-		return false, errors.Wrap(err, "read dir")
+		if code, ok := err.(containerExit); ok {
+			os.Exit(int(code))
+		}
+		if logFile {
+			logrus.Errorf("%v", err)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	for _, f := range files {
-		if f.Name() == ncName {
-			return true, nil
+}
+
+func bundleFlag(fs *flag.FlagSet) {
+	stringFlag(fs, "bundle, b", "", "path to the root of the bundle directory, defaults to the current directory")
+}
+
+// chdirBundle moves to the bundle directory, config.json and a relative
+// rootfs are looked up from the working directory.
+func chdirBundle(ctx *context) error {
+	if bundle := ctx.String("bundle"); bundle != "" {
+		if err := os.Chdir(bundle); err != nil {
+			return errors.Wrap(err, "chdir to bundle")
 		}
 	}
-	return false, nil
+	return nil
+}
+
+// containerExit is returned by an attached run to make runns exit with the
+// exit code of the container.
+type containerExit int
+
+func (e containerExit) Error() string {
+	return fmt.Sprintf("container exited with %d", int(e))
+}
+
+var killCommand = &command{
+	Name:      "kill",
+	ArgsUsage: "<container-id> [signal]",
+	Usage:     "send a signal, SIGKILL by default, to the container init process",
+	Flags: func(fs *flag.FlagSet) {
+		boolFlag(fs, "all, a", false, "send the signal to all processes in the container")
+	},
+	MinArgs: 1,
+	MaxArgs: 2,
+	Action:  kill,
 }
 
-func validateNcName() (string, error) {
-	if len(os.Args) < 3 {
-		return "", errors.New("missing args ...")
+func kill(ctx *context) error {
+	args := ctx.Args()
+	ncName := args[0]
+	sig := unix.SIGKILL
+	if len(args) > 1 {
+		var err error
+		if sig, err = parseSignal(args[1]); err != nil {
+			return err
+		}
 	}
-	ncName := os.Args[2]
-	exist, err := ncExist(ncName)
+	lock, err := lockContainer(ncName)
 	if err != nil {
-		return "", err
-	} else if exist {
-		return "", errors.Errorf("container %s exist", ncName)
+		return err
 	}
-	return ncName, nil
+	defer lock.Close()
+	state, err := loadState(ncName)
+	if err != nil {
+		return err
+	}
+	if err := state.verifyInit(); err != nil {
+		return err
+	}
+	return signalContainer(state, sig, ctx.Bool("all"))
 }
 
-func main() {
-	if len(os.Args) == 1 {
-		panic("missing cmdline input")
-	}
-	var err error
-	switch os.Args[1] {
-	case "run":
-		err = run()
-	case "child":
-		err = child()
-	case "kill":
-		err = kill()
-	case "list":
-		err = list()
-	default:
-		panic("unknonw input")
-	}
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+var deleteCommand = &command{
+	Name:      "delete",
+	ArgsUsage: "<container-id>",
+	Usage:     "delete a stopped container, running poststop hooks and removing its state",
+	Flags: func(fs *flag.FlagSet) {
+		boolFlag(fs, "force, f", false, "kill and delete the container even if it is still running")
+	},
+	MinArgs: 1,
+	MaxArgs: 1,
+	Action:  destroy,
 }
 
-func kill() error {
-	if len(os.Args) < 3 {
-		return errors.New("kill missing target?")
+func destroy(ctx *context) error {
+	force := ctx.Bool("force")
+	lock, err := lockContainer(ctx.Args()[0])
+	if err != nil {
+		return err
 	}
-	ncName := os.Args[2]
-	if exist, err := ncExist(ncName); err != nil {
+	defer lock.Close()
+	state, err := loadState(ctx.Args()[0])
+	if err != nil {
 		return err
-	} else if !exist {
-		return errors.Errorf("container %s not exist", ncName)
 	}
-	pidStr, err := FileGetContents(path.Join(listPath, ncName))
+	state.refreshStatus()
+	switch state.Status {
+	case stateRunning:
+		if !force {
+			return errors.Errorf("container %s is running, stop it first or use --force", state.ID)
+		}
+		fallthrough
+	case stateCreated:
+		if err := killContainer(state); err != nil {
+			return err
+		}
+	}
+	return destroyContainer(state)
+}
+
+var listCommand = &command{
+	Name:    "list",
+	Usage:   "list id, pid, status and bundle of every container",
+	MaxArgs: 0,
+	Action:  list,
+}
+
+func list(ctx *context) error {
+	states, err := listStates()
 	if err != nil {
-		return errors.Wrap(err, "fetch container failed")
+		return err
+	}
+	var prints string
+	for _, state := range states {
+		state.refreshStatus()
+		prints += fmt.Sprintf("%s %d %s %s\n", state.ID, state.InitProcessPid, state.Status, state.Bundle)
 	}
-	pid, err := strconv.Atoi(pidStr)
+	fmt.Print(prints)
+	return nil
+}
+
+var stateCommand = &command{
+	Name:      "state",
+	ArgsUsage: "<container-id>",
+	Usage:     "output the OCI runtime state of a container as JSON",
+	MinArgs:   1,
+	MaxArgs:   1,
+	Action:    state,
+}
+
+func state(ctx *context) error {
+	state, err := loadState(ctx.Args()[0])
 	if err != nil {
-		return errors.Wrap(err, "convert pid to int failed")
+		return err
 	}
-	p, err := os.FindProcess(pid)
+	state.refreshStatus()
+	content, err := json.MarshalIndent(state.ociState(), "", "  ")
 	if err != nil {
-		return errors.Wrap(err, "find process")
+		return errors.Wrap(err, "marshal state")
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+var createCommand = &command{
+	Name:      "create",
+	ArgsUsage: "<container-id>",
+	Usage:     "create a container, its process waits for `runns start`",
+	Flags: func(fs *flag.FlagSet) {
+		bundleFlag(fs)
+		networkFlags(fs)
+	},
+	MinArgs: 1,
+	MaxArgs: 1,
+	Action:  create,
+}
+
+func create(ctx *context) error {
+	if err := chdirBundle(ctx); err != nil {
+		return err
 	}
-	err = os.Remove(path.Join(listPath, ncName))
+	ncName := ctx.Args()[0]
+	lock, err := newContainerDir(ncName)
 	if err != nil {
-		return errors.Wrap(err, "remove pid file")
+		return err
 	}
-	err = p.Kill()
+	defer lock.Close()
+	_, err = createContainer(ncName, networkOptions(ctx))
+	return err
+}
+
+var startCommand = &command{
+	Name:      "start",
+	ArgsUsage: "<container-id>",
+	Usage:     "execute the process of a created container",
+	MinArgs:   1,
+	MaxArgs:   1,
+	Action:    start,
+}
+
+func start(ctx *context) error {
+	lock, err := lockContainer(ctx.Args()[0])
 	if err != nil {
-		return errors.Wrap(err, "kill process")
+		return err
 	}
-	return nil
+	defer lock.Close()
+	return startContainer(ctx.Args()[0])
 }
 
-func list() error {
-	files, err := ioutil.ReadDir(listPath)
+var runCommand = &command{
+	Name:      "run",
+	ArgsUsage: "<container-id>",
+	Usage:     "create and start a container, waiting for it and exiting with its exit code",
+	Flags: func(fs *flag.FlagSet) {
+		bundleFlag(fs)
+		networkFlags(fs)
+		boolFlag(fs, "detach, d", false, "return once the container is started")
+	},
+	MinArgs: 1,
+	MaxArgs: 1,
+	Action:  run,
+}
+
+func run(ctx *context) error {
+	if err := chdirBundle(ctx); err != nil {
+		return err
+	}
+	ncName := ctx.Args()[0]
+	lock, err := newContainerDir(ncName)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	cmd, err := createContainer(ncName, networkOptions(ctx))
 	if err != nil {
-		return errors.Wrap(err, "read dir")
+		return err
 	}
-	var prints string
-	for _, f := range files {
-		if f.Mode().IsRegular() {
-			name := f.Name()
-			pidStr, err := FileGetContents(path.Join(listPath, name))
-			if err != nil {
-				return errors.Wrap(err, "read list path files")
+	if ctx.Bool("detach") {
+		return startContainer(ncName)
+	}
+
+	// forward signals from the start on, the container may be killed
+	// before it execs
+	sigC := make(chan os.Signal, 16)
+	signal.Notify(sigC)
+	defer signal.Stop(sigC)
+	go func() {
+		for sig := range sigC {
+			// SIGURG is used by the go runtime for preemption
+			if sig == unix.SIGCHLD || sig == unix.SIGURG {
+				continue
 			}
-			prints += fmt.Sprintf("%s %s\n", name, pidStr)
+			cmd.Process.Signal(sig)
 		}
+	}()
+	if err := startContainer(ncName); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
 	}
-	print(prints)
-	return nil
+	// let kill and delete in while the container runs
+	lock.Close()
+	cmd.Wait()
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	exitStatus := status.ExitStatus()
+	if status.Signaled() {
+		exitStatus = 128 + int(status.Signal())
+	}
+	if lock, err = lockContainer(ncName); err != nil {
+		// deleted by `delete --force` meanwhile
+		return containerExit(exitStatus)
+	}
+	defer lock.Close()
+	state, err := loadState(ncName)
+	if err != nil {
+		return err
+	}
+	state.Status = stateStopped
+	state.ExitStatus = &exitStatus
+	if err := state.save(); err != nil {
+		return err
+	}
+	return containerExit(exitStatus)
 }
 
-func run() error {
-	_, err := os.Lstat(listPath)
+// createContainer sets up the namespaces and rootfs of container ncName,
+// leaving its init process blocked on the exec fifo until startContainer.
+// The container directory is made by newContainerDir beforehand, and
+// removed again on failure. netOpts override the network annotations of
+// the spec.
+func createContainer(ncName string, netOpts map[string]string) (*exec.Cmd, error) {
+	spec, err := initSpec(specConfig)
+	if err != nil {
+		removeContainerDir(ncName)
+		return nil, err
+	}
+	cmd, err := doCreateContainer(ncName, spec, netOpts)
 	if err != nil {
-		err = os.MkdirAll(listPath, os.ModePerm)
-		if err != nil {
-			return errors.Wrap(err, "mkdir for list path")
+		removeContainerDir(ncName)
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// removeContainerDir removes the directory of a container which failed to
+// be created. A leftover directory would block the name, so failures are
+// logged along with the error of the create.
+func removeContainerDir(ncName string) {
+	ncPath := containerPath(ncName)
+	if err := unmountAll(ncPath); err != nil {
+		logrus.Warnf("unmount leftover mounts: %v", err)
+	}
+	if err := os.RemoveAll(ncPath); err != nil {
+		logrus.Warnf("remove container dir: %v", err)
+	}
+}
+
+func doCreateContainer(ncName string, spec *specs.Spec, netOpts map[string]string) (*exec.Cmd, error) {
+	config, err := prepareConfig(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "prepare config")
+	}
+	if rootless {
+		if err := setupRootlessSpec(spec); err != nil {
+			return nil, err
 		}
 	}
-	ncName, err := validateNcName()
+	bundle, err := os.Getwd()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal spec")
+	}
+	// keep the spec around for the commands run after create, e.g. delete
+	// running the poststop hooks
+	if err := writeFileAtomic(containerPath(ncName, specConfig), specBytes); err != nil {
+		return nil, errors.Wrap(err, "save spec")
+	}
+	extras, err := loadSpecExtras(specConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "load spec")
 	}
+	cloneFlags, err := namespaceCloneFlags(spec)
+	if err != nil {
+		return nil, err
+	}
+	network, err := loadNetworkConfig(spec, netOpts)
+	if err != nil {
+		return nil, err
+	}
+	if rootless && network != nil && network.Mode != networkNone {
+		return nil, errors.Errorf("network mode %s needs root, rootless containers only get a loopback", network.Mode)
+	}
+	cgroups, err := newCgroupManager(spec, ncName)
+	if err != nil {
+		return nil, err
+	}
+	fifoPath := containerPath(ncName, execFifo)
+	if err := unix.Mkfifo(fifoPath, 0622); err != nil {
+		return nil, errors.Wrap(err, "create exec fifo")
+	}
+	// Opening the fifo read-write never blocks, and keeps the child's read
+	// blocked until `start` writes to it: the child itself holds a writer.
+	fifo, err := os.OpenFile(fifoPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "open exec fifo")
+	}
+	defer fifo.Close()
 
-	spec, err := initSpec(specConfig)
+	parentPipe, childPipe, err := newSyncPipePair()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cmd := exec.Command("/proc/self/exe", append([]string{"child"}, os.Args[2:]...)...)
+	defer parentPipe.Close()
+
+	args := append(append([]string{}, logArgs...), "child", ncName)
+	cmd := exec.Command("/proc/self/exe", args...)
 	cmd.SysProcAttr = &unix.SysProcAttr{
-		// Cloneflags: unix.CLONE_NEWUTS | unix.CLONE_NEWPID | unix.CLONE_NEWNS,
-		Cloneflags: unix.CLONE_NEWNS | unix.CLONE_NEWPID,
+		Cloneflags: cloneFlags,
+	}
+	if err := setupUserNamespace(cmd.SysProcAttr, spec); err != nil {
+		return nil, err
 	}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{fifo, childPipe}
 	// cmd.Dir = spec.Root.Path
 
-	specBytes, err := json.Marshal(spec)
-	if err != nil {
-		return errors.Wrap(err, "marshal spec")
-	}
 	cmd.Env = append(cmd.Env,
-		fmt.Sprintf("_LIBCONTAINER_SPEC=%s", specBytes),
+		// ExtraFiles start right after stderr
+		fmt.Sprintf("_LIBCONTAINER_FIFOFD=%d", 3),
+		fmt.Sprintf("_LIBCONTAINER_INITPIPE=%d", 4),
 		// fmt.Sprintf("_LIBCONTAINER_NCNAME=%s", ncName),
 	)
 
 	// start replase run for detach mode
-	if err := cmd.Start(); err != nil {
-		return errors.Wrap(err, "start child")
+	err = startInNamespaces(cmd, spec)
+	childPipe.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "start child")
+	}
+	// fail kills init and releases its cgroups and network before the
+	// container directory is removed
+	fail := func(err error) (*exec.Cmd, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if cerr := cgroups.Destroy(); cerr != nil {
+			logrus.Warnf("destroy cgroups: %v", cerr)
+		}
+		if nerr := teardownNetwork(ncName, network); nerr != nil {
+			logrus.Warnf("teardown network: %v", nerr)
+		}
+		return nil, err
 	}
-	err = FilePutContents(path.Join(listPath, ncName), strconv.Itoa(cmd.Process.Pid), false)
+	joined, err := applyCgroups(cgroups, spec, cmd.Process.Pid)
 	if err != nil {
-		return errors.Wrap(err, "put parent pid")
+		return fail(err)
+	}
+	if err := setupHostNetwork(ncName, network, cmd.Process.Pid); err != nil {
+		return fail(errors.Wrap(err, "setup host network"))
+	}
+	err = bootstrapInit(parentPipe, &bootstrapData{
+		Spec:       spec,
+		Umask:      extras.Umask,
+		Domainname: extras.Domainname,
+		Network:    network,
+		Rootless:   rootless,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	startTime, err := getProcessStartTime(cmd.Process.Pid)
+	if err != nil {
+		return fail(errors.Wrap(err, "get init process start time"))
+	}
+	pidNs, err := getPidNsInode(cmd.Process.Pid)
+	if err != nil {
+		return fail(errors.Wrap(err, "get init process pid namespace"))
+	}
+	state := &containerState{
+		ID:                   ncName,
+		Status:               stateCreated,
+		InitProcessPid:       cmd.Process.Pid,
+		InitProcessStartTime: startTime,
+		InitProcessPidNs:     pidNs,
+		PidNsShared:          namespacePath(spec, specs.PIDNamespace) != "",
+		Bundle:               bundle,
+		Rootfs:               config.Rootfs,
+		Annotations:          spec.Annotations,
+		Network:              network,
+		Created:              time.Now().UTC(),
+	}
+	if joined != nil {
+		state.CgroupPaths = joined.Paths()
+	}
+	if err := state.save(); err != nil {
+		return fail(errors.Wrap(err, "save state"))
+	}
+	return cmd, nil
+}
+
+// bootstrapInit sends bootstrap to the init process and waits until it is
+// ready to exec, returning the error init reports if any.
+func bootstrapInit(pipe *syncPipe, bootstrap *bootstrapData) error {
+	if err := pipe.send(&syncMsg{Type: syncBootstrap, Bootstrap: bootstrap}); err != nil {
+		return errors.Wrap(err, "send bootstrap data")
+	}
+	stage := "bootstrap"
+	for {
+		msg, err := pipe.recv()
+		if err == io.EOF {
+			return errors.Errorf("container init exited during %s", stage)
+		} else if err != nil {
+			return errors.Wrap(err, "read init pipe")
+		}
+		switch msg.Type {
+		case syncProgress:
+			stage = msg.Message
+		case syncError:
+			return errors.New(msg.Message)
+		case syncReady:
+			return nil
+		default:
+			return errors.Errorf("unexpected message %q from init", msg.Type)
+		}
 	}
-	return nil
 }
 
-func child() error {
+// startContainer releases the init process of a created container by
+// writing to its exec fifo.
+func startContainer(ncName string) error {
+	state, err := loadState(ncName)
+	if err != nil {
+		return err
+	}
+	fifoPath := containerPath(ncName, execFifo)
+	// Nonblocking open fails with ENXIO instead of hanging when the init
+	// process is gone and nobody holds the read side any more.
+	fifo, err := os.OpenFile(fifoPath, os.O_WRONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("container %s has already been started", ncName)
+		}
+		if pe, ok := err.(*os.PathError); ok && pe.Err == unix.ENXIO {
+			return errors.Errorf("container %s is not waiting for start", ncName)
+		}
+		return errors.Wrap(err, "open exec fifo")
+	}
+	defer fifo.Close()
+	if _, err := fifo.Write([]byte("0")); err != nil {
+		return errors.Wrap(err, "write exec fifo")
+	}
+	if err := os.Remove(fifoPath); err != nil {
+		return errors.Wrap(err, "remove exec fifo")
+	}
+	state.Status = stateRunning
+	return state.save()
+}
+
+var childCommand = &command{
+	Name:    "child",
+	Usage:   "container init, run by create",
+	Hidden:  true,
+	MaxArgs: -1,
+	Action:  child,
+}
+
+func child(ctx *context) error {
+	// credentials are set per thread by setupUser, the thread doing so has
+	// to be the one exec'ing the user process
+	runtime.LockOSThread()
+
 	//setsid
 	sid, err := unix.Setsid()
 	if err != nil {
@@ -178,42 +605,100 @@ func child() error {
 		return errors.New("child setsid is -1")
 	}
 
-	_, err = os.Lstat(listPath)
-	if err != nil {
-		err = os.MkdirAll(listPath, os.ModePerm)
-		if err != nil {
-			return errors.Wrap(err, "mkdir for list path")
-		}
-	}
 	// ncName := os.Getenv("_LIBCONTAINER_NCNAME")
 	// if len(ncName) == 0 {
 	// 	return errors.New("missing ncname")
 	// }
-	return initRun()
+	fd, err := strconv.Atoi(os.Getenv("_LIBCONTAINER_INITPIPE"))
+	if err != nil {
+		return errors.Wrap(err, "convert init pipe fd to int failed")
+	}
+	pipe := newSyncPipe(os.NewFile(uintptr(fd), "initpipe"))
+	err = initRun(pipe)
+	if err != nil {
+		// have runns report the error, falling back to print it when runns
+		// is not listening any more
+		if pipe.send(&syncMsg{Type: syncError, Message: err.Error()}) == nil {
+			os.Exit(1)
+		}
+	}
+	return err
 }
 
 // run in child process
-func initRun() error {
-	var spec = new(specs.Spec)
-	specStr := os.Getenv("_LIBCONTAINER_SPEC")
-	err := json.Unmarshal([]byte(specStr), spec)
+func initRun(pipe *syncPipe) error {
+	msg, err := pipe.recv()
 	if err != nil {
-		return errors.Wrap(err, "unmarshal spec")
+		return errors.Wrap(err, "read bootstrap data")
+	}
+	if msg.Type != syncBootstrap || msg.Bootstrap == nil {
+		return errors.Errorf("expect bootstrap data, got %q", msg.Type)
+	}
+	spec := msg.Bootstrap.Spec
+	rootless = msg.Bootstrap.Rootless
+	// runns sends the bootstrap data once init is in its cgroups
+	if err := unshareCgroupNamespace(spec); err != nil {
+		return err
 	}
 	config, err := prepareConfig(spec)
 	if err != nil {
 		return errors.Wrap(err, "prepare config")
 	}
+	pipe.progress("setup network")
+	if err := setupNetwork(msg.Bootstrap.Network); err != nil {
+		return errors.Wrap(err, "setup network")
+	}
+	if err := setupUTS(spec, config.Hostname, msg.Bootstrap.Domainname); err != nil {
+		return err
+	}
+	pipe.progress("prepare rootfs")
 	err = prepareRootfs(config)
 	if err != nil {
 		return errors.Wrap(err, "prepare rootfs")
 	}
-	name, err := exec.LookPath(spec.Process.Args[0])
+	pipe.progress("setup process")
+	if err := unix.Chdir(spec.Process.Cwd); err != nil {
+		return errors.Wrapf(err, "chdir to cwd %q", spec.Process.Cwd)
+	}
+	user, err := resolveUser(spec.Process.User)
+	if err != nil {
+		return errors.Wrap(err, "resolve user")
+	}
+	env := processEnv(spec.Process.Env)
+	name, err := lookPath(spec.Process.Args[0], env)
 	if err != nil {
 		return errors.Wrap(err, "look path")
 	}
-	if err := syscall.Exec(name, spec.Process.Args[0:], os.Environ()); err != nil {
+	unix.Umask(int(msg.Bootstrap.Umask))
+	if err := setupUser(user, !rootless); err != nil {
+		return err
+	}
+	if err := pipe.send(&syncMsg{Type: syncReady}); err != nil {
+		return errors.Wrap(err, "send ready")
+	}
+	// errors from now on are printed, nobody waits for them on the pipe
+	pipe.Close()
+	if err := waitExecFifo(); err != nil {
+		return err
+	}
+	if err := syscall.Exec(name, spec.Process.Args[0:], env); err != nil {
 		return errors.Wrap(err, "exec user process")
 	}
 	return nil
 }
+
+// waitExecFifo blocks until `start` writes to the exec fifo inherited from
+// the create process.
+func waitExecFifo() error {
+	fd, err := strconv.Atoi(os.Getenv("_LIBCONTAINER_FIFOFD"))
+	if err != nil {
+		return errors.Wrap(err, "convert fifo fd to int failed")
+	}
+	fifo := os.NewFile(uintptr(fd), execFifo)
+	defer fifo.Close()
+	buf := make([]byte, 1)
+	if _, err := fifo.Read(buf); err != nil {
+		return errors.Wrap(err, "read exec fifo")
+	}
+	return nil
+}
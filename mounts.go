@@ -5,8 +5,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/mount"
 	"github.com/mrunalp/fileutils"
 	"github.com/opencontainers/runc/libcontainer/configs"
@@ -245,19 +247,37 @@ func mountToRootfs(m *configs.Mount, rootfs, mountLabel string) error {
 			return err
 		}
 		// Selinux kernels do not support labeling of /proc or /sys
-		return mountPropagate(m, rootfs, "")
-	// case "mqueue":
-	//  if err := os.MkdirAll(dest, 0755); err != nil {
-	//      return err
-	//  }
-	//  if err := mountPropagate(m, rootfs, mountLabel); err != nil {
-	//      // older kernels do not support labeling of /dev/mqueue
-	//      if err := mountPropagate(m, rootfs, ""); err != nil {
-	//          return err
-	//      }
-	//      return label.SetFileLabel(dest, mountLabel)
-	//  }
-	//  return nil
+		err := mountPropagate(m, rootfs, "")
+		if err == unix.EPERM && rootless && m.Device == "sysfs" {
+			// sysfs needs a network namespace owned by the user
+			// namespace, bind the one of the host instead
+			bind := *m
+			bind.Source = "/sys"
+			bind.Device = "bind"
+			bind.Flags |= unix.MS_BIND | unix.MS_REC
+			if err := mountPropagate(&bind, rootfs, ""); err != nil {
+				return err
+			}
+			return remount(&bind, rootfs)
+		}
+		return err
+	case "mqueue":
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		if err := mountPropagate(m, rootfs, mountLabel); err != nil {
+			// older kernels do not support labeling of /dev/mqueue
+			if err := mountPropagate(m, rootfs, ""); err != nil {
+				// nor the mqueue filesystem at all without
+				// CONFIG_POSIX_MQUEUE, the container has to go without
+				if err == unix.ENODEV {
+					logrus.Warnf("mqueue filesystem is not supported by the kernel, skip mounting %s", m.Destination)
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
 	case "tmpfs":
 		var copyUp = false
 		// copyUp := m.Extensions&1 == 1
@@ -423,10 +443,16 @@ func remount(m *configs.Mount, rootfs string) error {
 	if !strings.HasPrefix(dest, rootfs) {
 		dest = filepath.Join(rootfs, dest)
 	}
-	if err := unix.Mount(m.Source, dest, m.Device, uintptr(m.Flags|unix.MS_REMOUNT), ""); err != nil {
-		return err
+	err := unix.Mount(m.Source, dest, m.Device, uintptr(m.Flags|unix.MS_REMOUNT), "")
+	if err == unix.EPERM && rootless {
+		// keep the flags an unprivileged user may not clear
+		locked, lerr := lockedMountFlags(dest)
+		if lerr != nil {
+			return lerr
+		}
+		err = unix.Mount(m.Source, dest, m.Device, uintptr(m.Flags|locked|unix.MS_REMOUNT), "")
 	}
-	return nil
+	return err
 }
 
 func getMountInfo(mountinfo []*mount.Info, dir string) *mount.Info {
@@ -471,6 +497,29 @@ func getParentMount(rootfs string) (string, string, error) {
 	return "", "", fmt.Errorf("Could not find parent mount of %s", rootfs)
 }
 
+// unmountAll lazily unmounts every mount point at or below dir, deepest
+// first.
+func unmountAll(dir string) error {
+	mountinfos, err := mount.GetMounts()
+	if err != nil {
+		return err
+	}
+	var targets []string
+	for _, m := range mountinfos {
+		if m.Mountpoint == dir || strings.HasPrefix(m.Mountpoint, dir+"/") {
+			targets = append(targets, m.Mountpoint)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(targets)))
+	for _, target := range targets {
+		// EINVAL: already gone along with a mount above it
+		if err := unix.Unmount(target, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			return errors.Wrapf(err, "unmount %s", target)
+		}
+	}
+	return nil
+}
+
 // Make parent mount private if it was shared
 func rootfsParentMountPrivate(rootfs string) error {
 	sharedMount := false
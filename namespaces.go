@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// namespaceFlags are the namespaces runns can create for a container.
+var namespaceFlags = map[specs.LinuxNamespaceType]uintptr{
+	specs.MountNamespace:   unix.CLONE_NEWNS,
+	specs.PIDNamespace:     unix.CLONE_NEWPID,
+	specs.UTSNamespace:     unix.CLONE_NEWUTS,
+	specs.IPCNamespace:     unix.CLONE_NEWIPC,
+	specs.NetworkNamespace: unix.CLONE_NEWNET,
+	specs.CgroupNamespace:  unix.CLONE_NEWCGROUP,
+	specs.UserNamespace:    unix.CLONE_NEWUSER,
+}
+
+// namespaceFiles are the names of the namespaces in /proc/<pid>/ns.
+var namespaceFiles = map[specs.LinuxNamespaceType]string{
+	specs.MountNamespace:   "mnt",
+	specs.PIDNamespace:     "pid",
+	specs.UTSNamespace:     "uts",
+	specs.IPCNamespace:     "ipc",
+	specs.NetworkNamespace: "net",
+	specs.UserNamespace:    "user",
+	specs.CgroupNamespace:  "cgroup",
+}
+
+// joinableNamespaces can be joined by path. runns joins them on the thread
+// forking init, which then inherits them. Joining a mount or user namespace
+// is refused by the kernel for a multithreaded process like runns.
+var joinableNamespaces = []specs.LinuxNamespaceType{
+	specs.UTSNamespace,
+	specs.IPCNamespace,
+	specs.NetworkNamespace,
+	specs.CgroupNamespace,
+	specs.PIDNamespace,
+}
+
+// hasNamespace tells whether spec puts the container into a namespace of
+// type t of its own, either created or joined.
+func hasNamespace(spec *specs.Spec, t specs.LinuxNamespaceType) bool {
+	if spec.Linux == nil {
+		return false
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacePath returns the path of the namespace of type t the container
+// joins, empty when it is created or not in the spec at all.
+func namespacePath(spec *specs.Spec, t specs.LinuxNamespaceType) string {
+	if spec.Linux == nil {
+		return ""
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == t {
+			return ns.Path
+		}
+	}
+	return ""
+}
+
+// namespaceSupported checks the kernel for namespace type t. Kernels before
+// 3.0 have no /proc/self/ns at all, but do know the namespaces older than
+// the user and cgroup ones.
+func namespaceSupported(t specs.LinuxNamespaceType) bool {
+	if _, err := os.Stat("/proc/self/ns"); os.IsNotExist(err) {
+		return t != specs.UserNamespace && t != specs.CgroupNamespace
+	}
+	_, err := os.Stat("/proc/self/ns/" + namespaceFiles[t])
+	return err == nil
+}
+
+// namespaceCloneFlags returns the clone flags creating the namespaces of
+// spec.Linux.Namespaces without a path. A mount namespace is always
+// created, preparing the rootfs needs it. The cgroup namespace is left to
+// init, see unshareCgroupNamespace.
+func namespaceCloneFlags(spec *specs.Spec) (uintptr, error) {
+	var flags uintptr = unix.CLONE_NEWNS
+	if spec.Linux == nil {
+		return flags, nil
+	}
+	var seen = make(map[specs.LinuxNamespaceType]bool)
+	for _, ns := range spec.Linux.Namespaces {
+		if _, ok := namespaceFiles[ns.Type]; !ok {
+			return 0, errors.Errorf("unknown namespace type %q", ns.Type)
+		}
+		if seen[ns.Type] {
+			return 0, errors.Errorf("namespace %s is listed more than once", ns.Type)
+		}
+		seen[ns.Type] = true
+		if !namespaceSupported(ns.Type) {
+			return 0, errors.Errorf("namespace %s is not supported by the kernel", ns.Type)
+		}
+		if ns.Path != "" {
+			if ns.Type == specs.MountNamespace {
+				return 0, errors.Errorf("joining the mount namespace at %s is not supported, runns needs a new one for the rootfs", ns.Path)
+			}
+			if !namespaceJoinable(ns.Type) {
+				return 0, errors.Errorf("joining the %s namespace at %s is not supported", ns.Type, ns.Path)
+			}
+			continue
+		}
+		if ns.Type == specs.CgroupNamespace {
+			continue
+		}
+		flag, ok := namespaceFlags[ns.Type]
+		if !ok {
+			return 0, errors.Errorf("creating a %s namespace is not supported", ns.Type)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+func namespaceJoinable(t specs.LinuxNamespaceType) bool {
+	for _, joinable := range joinableNamespaces {
+		if t == joinable {
+			return true
+		}
+	}
+	return false
+}
+
+// startInNamespaces starts cmd on a thread which joined the namespaces of
+// spec having a path, so that the cloned init lives in them too. For the
+// pid namespace setns only affects the children, which is just what is
+// needed here.
+func startInNamespaces(cmd *exec.Cmd, spec *specs.Spec) error {
+	var joins []specs.LinuxNamespace
+	for _, t := range joinableNamespaces {
+		if path := namespacePath(spec, t); path != "" {
+			joins = append(joins, specs.LinuxNamespace{Type: t, Path: path})
+		}
+	}
+	if len(joins) == 0 {
+		return cmd.Start()
+	}
+	errC := make(chan error, 1)
+	go func() {
+		// never unlocked: the thread is thrown away with the goroutine
+		// instead of running other goroutines in the joined namespaces
+		runtime.LockOSThread()
+		for _, ns := range joins {
+			if err := setns(ns.Path, namespaceFlags[ns.Type]); err != nil {
+				errC <- errors.Wrapf(err, "join %s namespace %s", ns.Type, ns.Path)
+				return
+			}
+		}
+		errC <- cmd.Start()
+	}()
+	return <-errC
+}
+
+// setns moves the calling thread into the namespace at path.
+func setns(path string, nstype uintptr) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Setns(int(f.Fd()), int(nstype))
+}
+
+// unshareCgroupNamespace creates the cgroup namespace of the container.
+// Its root is the cgroup of the process creating it, so init does it once
+// runns has moved it into the cgroups of the container, like runc. Init
+// runs locked to the thread which execs, the only one in the namespace.
+func unshareCgroupNamespace(spec *specs.Spec) error {
+	if !hasNamespace(spec, specs.CgroupNamespace) || namespacePath(spec, specs.CgroupNamespace) != "" {
+		return nil
+	}
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return errors.Wrap(err, "unshare cgroup namespace")
+	}
+	return nil
+}
+
+// setupUTS sets the hostname and domainname of the container, which needs
+// a UTS namespace of its own.
+func setupUTS(spec *specs.Spec, hostname, domainname string) error {
+	if hostname == "" && domainname == "" {
+		return nil
+	}
+	if !hasNamespace(spec, specs.UTSNamespace) {
+		return errors.New("unable to set hostname or domainname without a private UTS namespace")
+	}
+	if hostname != "" {
+		if err := unix.Sethostname([]byte(hostname)); err != nil {
+			return errors.Wrapf(err, "sethostname %s", hostname)
+		}
+	}
+	if domainname != "" {
+		if err := unix.Setdomainname([]byte(domainname)); err != nil {
+			return errors.Wrapf(err, "setdomainname %s", domainname)
+		}
+	}
+	return nil
+}
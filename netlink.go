@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// A minimal rtnetlink client, just enough to set up the container network.
+// The vendored x/sys/unix has the constants but no rtnetlink requests.
+
+// from include/uapi/linux/veth.h
+const vethInfoPeer = 1
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+func nlAlign(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
+
+// nlAttr encodes a route attribute, value being the payload or the nested
+// attributes.
+func nlAttr(typ uint16, value ...[]byte) []byte {
+	var payload []byte
+	for _, v := range value {
+		payload = append(payload, v...)
+	}
+	b := make([]byte, nlAlign(unix.SizeofRtAttr+len(payload)))
+	nativeEndian.PutUint16(b[0:2], uint16(unix.SizeofRtAttr+len(payload)))
+	nativeEndian.PutUint16(b[2:4], typ)
+	copy(b[unix.SizeofRtAttr:], payload)
+	return b
+}
+
+func nlUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+func nlString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	nativeEndian.PutUint32(b[8:12], flags)
+	nativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+func ifAddrmsg(family, prefixlen, flags, scope uint8, index int) []byte {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0], b[1], b[2], b[3] = family, prefixlen, flags, scope
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+func rtMsg(family, table, protocol, scope, typ uint8) []byte {
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0] = family
+	b[4], b[5], b[6], b[7] = table, protocol, scope, typ
+	return b
+}
+
+// netlinkRequest sends one request of type typ in the netns of the calling
+// thread and waits for the kernel to ack it.
+func netlinkRequest(typ, flags uint16, body ...[]byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return errors.Wrap(err, "netlink socket")
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return errors.Wrap(err, "bind netlink socket")
+	}
+	var payload []byte
+	for _, b := range body {
+		payload = append(payload, b...)
+	}
+	msg := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	nativeEndian.PutUint32(msg[0:4], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	nativeEndian.PutUint16(msg[4:6], typ)
+	nativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, payload...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return errors.Wrap(err, "send netlink request")
+	}
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return errors.Wrap(err, "receive netlink reply")
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return errors.Wrap(err, "parse netlink reply")
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != 1 || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short netlink error reply")
+			}
+			// the ack is an error message with errno 0
+			if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// linkIndex returns the index of interface name in the current netns.
+func linkIndex(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "find interface %s", name)
+	}
+	return iface.Index, nil
+}
+
+// linkAddVeth creates a veth pair, name in the current netns and peer in
+// the netns of process peerPid.
+func linkAddVeth(name, peer string, peerPid int) error {
+	err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+		ifInfomsg(0, 0, 0),
+		nlAttr(unix.IFLA_IFNAME, nlString(name)),
+		nlAttr(unix.IFLA_LINKINFO,
+			nlAttr(unix.IFLA_INFO_KIND, []byte("veth")),
+			nlAttr(unix.IFLA_INFO_DATA,
+				nlAttr(vethInfoPeer,
+					ifInfomsg(0, 0, 0),
+					nlAttr(unix.IFLA_IFNAME, nlString(peer)),
+					nlAttr(unix.IFLA_NET_NS_PID, nlUint32(uint32(peerPid)))))))
+	if err != nil {
+		return errors.Wrapf(err, "add veth pair %s", name)
+	}
+	return nil
+}
+
+func linkSetUp(index int) error {
+	if err := netlinkRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, unix.IFF_UP, unix.IFF_UP)); err != nil {
+		return errors.Wrapf(err, "set link %d up", index)
+	}
+	return nil
+}
+
+// linkSetMaster attaches link index to bridge master. Kernels before 3.0
+// do not take IFLA_MASTER, the bridge ioctl works there.
+func linkSetMaster(index int, master string) error {
+	masterIndex, err := linkIndex(master)
+	if err != nil {
+		return err
+	}
+	err = netlinkRequest(unix.RTM_NEWLINK, 0, ifInfomsg(index, 0, 0), nlAttr(unix.IFLA_MASTER, nlUint32(uint32(masterIndex))))
+	if err == nil {
+		return nil
+	}
+	fd, serr := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if serr != nil {
+		return errors.Wrapf(err, "attach link %d to bridge %s", index, master)
+	}
+	defer unix.Close(fd)
+	var ifr [unix.IFNAMSIZ + 24]byte
+	copy(ifr[:unix.IFNAMSIZ-1], master)
+	nativeEndian.PutUint32(ifr[unix.IFNAMSIZ:], uint32(index))
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCBRADDIF, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errors.Wrapf(errno, "attach link %d to bridge %s", index, master)
+	}
+	return nil
+}
+
+func linkDel(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	if err := netlinkRequest(unix.RTM_DELLINK, 0, ifInfomsg(index, 0, 0)); err != nil {
+		return errors.Wrapf(err, "delete link %s", name)
+	}
+	return nil
+}
+
+// addrAdd assigns addr to link index. Duplicate address detection is
+// skipped for IPv6, the address would not be usable until it is done.
+func addrAdd(index int, addr *net.IPNet) error {
+	family, ip := ipFamily(addr.IP)
+	var flags uint8
+	if family == unix.AF_INET6 {
+		flags = unix.IFA_F_NODAD
+	}
+	prefixlen, _ := addr.Mask.Size()
+	err := netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+		ifAddrmsg(family, uint8(prefixlen), flags, unix.RT_SCOPE_UNIVERSE, index),
+		nlAttr(unix.IFA_LOCAL, ip),
+		nlAttr(unix.IFA_ADDRESS, ip))
+	if err != nil {
+		return errors.Wrapf(err, "add address %s", addr)
+	}
+	return nil
+}
+
+// routeAddDefault adds a default route through gw on link index.
+func routeAddDefault(index int, gw net.IP) error {
+	family, ip := ipFamily(gw)
+	err := netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+		rtMsg(family, unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST),
+		nlAttr(unix.RTA_GATEWAY, ip),
+		nlAttr(unix.RTA_OIF, nlUint32(uint32(index))))
+	if err != nil {
+		return errors.Wrapf(err, "add default route via %s", gw)
+	}
+	return nil
+}
+
+// ipFamily returns the address family of ip and ip in its wire length.
+func ipFamily(ip net.IP) (uint8, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
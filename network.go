@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"net"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// network modes of a container with a network namespace of its own
+const (
+	// loopback only
+	networkNone = "none"
+	// a veth pair, the host end optionally attached to a bridge
+	networkVeth = "veth"
+	// set up by CNI plugins
+	networkCNI = "cni"
+)
+
+// annotations configuring the network, overridden by the network flags of
+// create and run
+const (
+	annotationNetworkMode      = "runns.network.mode"
+	annotationNetworkBridge    = "runns.network.bridge"
+	annotationNetworkInterface = "runns.network.interface"
+	annotationNetworkAddresses = "runns.network.addresses"
+	annotationNetworkGateways  = "runns.network.gateways"
+	annotationCNIConfDir       = "runns.cni.conf-dir"
+	annotationCNIBinDir        = "runns.cni.bin-dir"
+)
+
+const defaultNetworkInterface = "eth0"
+
+// networkConfig is how runns sets up the network namespace of a container.
+type networkConfig struct {
+	Mode   string `json:"mode"`
+	Bridge string `json:"bridge,omitempty"`
+	// Interface is the name of the veth end in the container.
+	Interface string `json:"interface,omitempty"`
+	// HostInterface is the name of the veth end on the host.
+	HostInterface string `json:"host_interface,omitempty"`
+	// Addresses are CIDRs, IPv4 or IPv6, assigned to Interface.
+	Addresses []string `json:"addresses,omitempty"`
+	// Gateways get a default route each, one per address family at most.
+	Gateways []string `json:"gateways,omitempty"`
+	// CNIConfDir and CNIBinDir are where the CNI network config and the
+	// plugins are looked up.
+	CNIConfDir string `json:"cni_conf_dir,omitempty"`
+	CNIBinDir  string `json:"cni_bin_dir,omitempty"`
+	// CNINetwork is the network the ADD ran, and CNIResult its result,
+	// both kept for the DEL.
+	CNINetwork *cniNetwork     `json:"cni_network,omitempty"`
+	CNIResult  json.RawMessage `json:"cni_result,omitempty"`
+}
+
+func networkFlags(fs *flag.FlagSet) {
+	stringFlag(fs, "network", "", "network mode of a new network namespace, none, veth or cni (annotation "+annotationNetworkMode+")")
+	stringFlag(fs, "network-bridge", "", "bridge to attach the host end of the veth pair to (annotation "+annotationNetworkBridge+")")
+	stringFlag(fs, "network-interface", "", "name of the veth end in the container, eth0 by default (annotation "+annotationNetworkInterface+")")
+	stringFlag(fs, "network-address", "", "comma separated IPv4/IPv6 CIDRs of the container interface (annotation "+annotationNetworkAddresses+")")
+	stringFlag(fs, "network-gateway", "", "comma separated default gateways of the container (annotation "+annotationNetworkGateways+")")
+	stringFlag(fs, "cni-conf-dir", "", "CNI network config directory, "+defaultCNIConfDir+" by default (annotation "+annotationCNIConfDir+")")
+	stringFlag(fs, "cni-bin-dir", "", "colon separated CNI plugin directories, "+defaultCNIBinDir+" by default (annotation "+annotationCNIBinDir+")")
+}
+
+// networkOptions returns the network flags of ctx as annotations, to be
+// laid over the ones of the spec.
+func networkOptions(ctx *context) map[string]string {
+	var opts = make(map[string]string)
+	for flagName, annotation := range map[string]string{
+		"network":           annotationNetworkMode,
+		"network-bridge":    annotationNetworkBridge,
+		"network-interface": annotationNetworkInterface,
+		"network-address":   annotationNetworkAddresses,
+		"network-gateway":   annotationNetworkGateways,
+		"cni-conf-dir":      annotationCNIConfDir,
+		"cni-bin-dir":       annotationCNIBinDir,
+	} {
+		if v := ctx.String(flagName); v != "" {
+			opts[annotation] = v
+		}
+	}
+	return opts
+}
+
+// loadNetworkConfig builds the network config of a container from the
+// spec annotations and opts. It is nil when the container has no network
+// namespace of its own, which then must not be configured. A new network
+// namespace defaults to mode none.
+func loadNetworkConfig(spec *specs.Spec, opts map[string]string) (*networkConfig, error) {
+	get := func(key string) string {
+		if v, ok := opts[key]; ok {
+			return v
+		}
+		return spec.Annotations[key]
+	}
+	config := &networkConfig{
+		Mode:      get(annotationNetworkMode),
+		Bridge:    get(annotationNetworkBridge),
+		Interface: get(annotationNetworkInterface),
+		Addresses: splitList(get(annotationNetworkAddresses)),
+		Gateways:  splitList(get(annotationNetworkGateways)),
+	}
+	if !hasNamespace(spec, specs.NetworkNamespace) || namespacePath(spec, specs.NetworkNamespace) != "" {
+		if config.Mode != "" {
+			return nil, errors.Errorf("network mode %s needs a new network namespace", config.Mode)
+		}
+		return nil, nil
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = networkNone
+		fallthrough
+	case networkNone:
+		if config.Bridge != "" || config.Interface != "" || len(config.Addresses) > 0 || len(config.Gateways) > 0 {
+			return nil, errors.New("network mode none takes no bridge, interface, addresses or gateways")
+		}
+		return config, nil
+	case networkVeth, networkCNI:
+	default:
+		return nil, errors.Errorf("unknown network mode %q", config.Mode)
+	}
+	if config.Interface == "" {
+		config.Interface = defaultNetworkInterface
+	}
+	if len(config.Interface) >= 16 {
+		return nil, errors.Errorf("interface name %q is longer than 15 characters", config.Interface)
+	}
+	if config.Mode == networkCNI {
+		if config.Bridge != "" || len(config.Addresses) > 0 || len(config.Gateways) > 0 {
+			return nil, errors.New("network mode cni takes no bridge, addresses or gateways, the plugins set them up")
+		}
+		config.CNIConfDir = get(annotationCNIConfDir)
+		if config.CNIConfDir == "" {
+			config.CNIConfDir = defaultCNIConfDir
+		}
+		config.CNIBinDir = get(annotationCNIBinDir)
+		if config.CNIBinDir == "" {
+			config.CNIBinDir = defaultCNIBinDir
+		}
+		return config, nil
+	}
+	for _, addr := range config.Addresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return nil, errors.Errorf("invalid network address %q, expect a CIDR", addr)
+		}
+	}
+	var families = make(map[uint8]bool)
+	for _, gw := range config.Gateways {
+		ip := net.ParseIP(gw)
+		if ip == nil {
+			return nil, errors.Errorf("invalid gateway %q", gw)
+		}
+		family, _ := ipFamily(ip)
+		if families[family] {
+			return nil, errors.Errorf("more than one default gateway of the address family of %s", gw)
+		}
+		families[family] = true
+	}
+	name, err := hostInterfaceName()
+	if err != nil {
+		return nil, err
+	}
+	config.HostInterface = name
+	return config, nil
+}
+
+// hostInterfaceName returns a random name for the host end of a veth pair,
+// container ids are too long for interface names.
+func hostInterfaceName() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate interface name")
+	}
+	return "veth" + hex.EncodeToString(b), nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// setupHostNetwork creates the veth pair of a container whose init is pid,
+// or runs the CNI plugins on its network namespace. It is run by runns on
+// the host before init configures the network.
+func setupHostNetwork(ncName string, config *networkConfig, pid int) error {
+	if config == nil {
+		return nil
+	}
+	if config.Mode == networkCNI {
+		return cniAdd(ncName, config, pid)
+	}
+	if config.Mode != networkVeth {
+		return nil
+	}
+	if err := linkAddVeth(config.HostInterface, config.Interface, pid); err != nil {
+		return err
+	}
+	index, err := linkIndex(config.HostInterface)
+	if err != nil {
+		return err
+	}
+	if config.Bridge != "" {
+		if err := linkSetMaster(index, config.Bridge); err != nil {
+			return err
+		}
+	}
+	return linkSetUp(index)
+}
+
+// setupNetwork configures the network namespace from within, run by init.
+func setupNetwork(config *networkConfig) error {
+	if config == nil {
+		return nil
+	}
+	lo, err := linkIndex("lo")
+	if err != nil {
+		return err
+	}
+	if err := linkSetUp(lo); err != nil {
+		return err
+	}
+	if config.Mode != networkVeth {
+		return nil
+	}
+	index, err := linkIndex(config.Interface)
+	if err != nil {
+		return err
+	}
+	for _, addr := range config.Addresses {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		ipnet.IP = ip
+		if err := addrAdd(index, ipnet); err != nil {
+			return err
+		}
+	}
+	if err := linkSetUp(index); err != nil {
+		return err
+	}
+	for _, gw := range config.Gateways {
+		if err := routeAddDefault(index, net.ParseIP(gw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownNetwork runs the CNI DEL of a container, or removes the host end
+// of its veth pair in case the namespace is kept alive, e.g. by a bind
+// mount.
+func teardownNetwork(ncName string, config *networkConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Mode == networkCNI {
+		return cniDel(ncName, config)
+	}
+	if config.HostInterface == "" {
+		return nil
+	}
+	if _, err := net.InterfaceByName(config.HostInterface); err != nil {
+		// gone along with the network namespace
+		return nil
+	}
+	return linkDel(config.HostInterface)
+}
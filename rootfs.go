@@ -119,6 +119,10 @@ func prepareRootfs(config *configs.Config) error {
 		// }
 	}
 
+	if err := createDevices(config); err != nil {
+		return err
+	}
+
 	// The reason these operations are done here rather than in finalizeRootfs
 	// is because the console-handling code gets quite sticky if we have to set
 	// up the console before doing the pivot_root(2). This is because the
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// rootless is set when runns runs as an unprivileged user, see --rootless.
+// Init learns it from the bootstrap data.
+var rootless bool
+
+// parseRootless parses the --rootless flag, auto meaning rootless for
+// anybody but root.
+func parseRootless(value string) (bool, error) {
+	switch value {
+	case "auto":
+		return os.Geteuid() != 0, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errors.Errorf("invalid --rootless value %q, expect true, false or auto", value)
+}
+
+// rootlessStateDir is the default state root of rootless containers, the
+// user may not write /run/runns.
+func rootlessStateDir() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return "", errors.New("XDG_RUNTIME_DIR is not set, use --root for the state of rootless containers")
+	}
+	return filepath.Join(dir, "runns"), nil
+}
+
+// setupRootlessSpec puts a rootless container into a user namespace, where
+// the user is root. A spec without one gets a user namespace mapping root
+// to the user. runns writes the id maps itself, without the setuid
+// newuidmap and newgidmap helpers, so the user can map its own uid and gid
+// only and setgroups is denied.
+func setupRootlessSpec(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		spec.Linux = new(specs.Linux)
+	}
+	if !hasNamespace(spec, specs.UserNamespace) {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+		if len(spec.Linux.UIDMappings) == 0 {
+			spec.Linux.UIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}}
+		}
+		if len(spec.Linux.GIDMappings) == 0 {
+			spec.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}}
+		}
+	}
+	if err := checkRootlessMappings("uid", spec.Linux.UIDMappings, os.Geteuid()); err != nil {
+		return err
+	}
+	if err := checkRootlessMappings("gid", spec.Linux.GIDMappings, os.Getegid()); err != nil {
+		return err
+	}
+	if spec.Process != nil && len(spec.Process.User.AdditionalGids) > 0 {
+		return errors.New("additional gids are not supported in rootless mode, setgroups is denied")
+	}
+	return nil
+}
+
+func checkRootlessMappings(kind string, mappings []specs.LinuxIDMapping, id int) error {
+	if len(mappings) != 1 || mappings[0].HostID != uint32(id) || mappings[0].Size != 1 {
+		return errors.Errorf("rootless mode can only map the %s %d of the user", kind, id)
+	}
+	return nil
+}
+
+// lockedMountFlags returns the mount flags of the mount at path a user
+// namespace can not clear, they are locked when the mount was made by a
+// more privileged namespace.
+func lockedMountFlags(path string) (int, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	var flags int
+	for stFlag, msFlag := range map[int64]int{
+		unix.ST_RDONLY:     unix.MS_RDONLY,
+		unix.ST_NOSUID:     unix.MS_NOSUID,
+		unix.ST_NODEV:      unix.MS_NODEV,
+		unix.ST_NOEXEC:     unix.MS_NOEXEC,
+		unix.ST_NOATIME:    unix.MS_NOATIME,
+		unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+		unix.ST_RELATIME:   unix.MS_RELATIME,
+	} {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	return flags, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var signalMap = map[string]unix.Signal{
+	"ABRT":   unix.SIGABRT,
+	"ALRM":   unix.SIGALRM,
+	"BUS":    unix.SIGBUS,
+	"CHLD":   unix.SIGCHLD,
+	"CLD":    unix.SIGCLD,
+	"CONT":   unix.SIGCONT,
+	"FPE":    unix.SIGFPE,
+	"HUP":    unix.SIGHUP,
+	"ILL":    unix.SIGILL,
+	"INT":    unix.SIGINT,
+	"IO":     unix.SIGIO,
+	"IOT":    unix.SIGIOT,
+	"KILL":   unix.SIGKILL,
+	"PIPE":   unix.SIGPIPE,
+	"POLL":   unix.SIGPOLL,
+	"PROF":   unix.SIGPROF,
+	"PWR":    unix.SIGPWR,
+	"QUIT":   unix.SIGQUIT,
+	"SEGV":   unix.SIGSEGV,
+	"STKFLT": unix.SIGSTKFLT,
+	"STOP":   unix.SIGSTOP,
+	"SYS":    unix.SIGSYS,
+	"TERM":   unix.SIGTERM,
+	"TRAP":   unix.SIGTRAP,
+	"TSTP":   unix.SIGTSTP,
+	"TTIN":   unix.SIGTTIN,
+	"TTOU":   unix.SIGTTOU,
+	"URG":    unix.SIGURG,
+	"USR1":   unix.SIGUSR1,
+	"USR2":   unix.SIGUSR2,
+	"VTALRM": unix.SIGVTALRM,
+	"WINCH":  unix.SIGWINCH,
+	"XCPU":   unix.SIGXCPU,
+	"XFSZ":   unix.SIGXFSZ,
+}
+
+// parseSignal accepts a signal number, or a name with or without the SIG
+// prefix, e.g. 9, KILL, SIGKILL.
+func parseSignal(rawSignal string) (unix.Signal, error) {
+	s, err := strconv.Atoi(rawSignal)
+	if err == nil {
+		if s <= 0 || s > 64 {
+			return -1, errors.Errorf("invalid signal %s", rawSignal)
+		}
+		return unix.Signal(s), nil
+	}
+	signal, ok := signalMap[strings.TrimPrefix(strings.ToUpper(rawSignal), "SIG")]
+	if !ok {
+		return -1, errors.Errorf("unknown signal %q", rawSignal)
+	}
+	return signal, nil
+}
+
+// containerProcesses returns the pids of every process in the container.
+// They are the processes sharing the pid namespace of the init process, or
+// the descendants of init when the namespace can not be told apart from
+// the host one or is shared with other processes.
+func containerProcesses(s *containerState) ([]int, error) {
+	hostPidNs, err := getPidNsInode(os.Getpid())
+	if err != nil {
+		return nil, errors.Wrap(err, "get host pid namespace")
+	}
+	files, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "read /proc")
+	}
+	byNs := s.InitProcessPidNs != 0 && s.InitProcessPidNs != hostPidNs && !s.PidNsShared
+	var pids []int
+	var children = make(map[int][]int)
+	for _, f := range files {
+		pid, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		if byNs {
+			ino, err := getPidNsInode(pid)
+			if err != nil {
+				// the process exited while walking /proc
+				continue
+			}
+			if ino == s.InitProcessPidNs {
+				pids = append(pids, pid)
+			}
+		} else {
+			ppid, err := getProcessPpid(pid)
+			if err != nil {
+				continue
+			}
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+	if byNs {
+		return pids, nil
+	}
+	queue := []int{s.InitProcessPid}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		pids = append(pids, pid)
+		queue = append(queue, children[pid]...)
+	}
+	return pids, nil
+}
+
+// getProcessPpid returns the ppid field (4th) of /proc/<pid>/stat.
+func getProcessPpid(pid int) (int, error) {
+	fields, err := getProcessStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// signalContainer sends sig to the container init, or to every process of
+// the container when all is set.
+func signalContainer(s *containerState, sig unix.Signal, all bool) error {
+	if !all {
+		if err := unix.Kill(s.InitProcessPid, sig); err != nil {
+			return errors.Wrapf(err, "signal init process %d", s.InitProcessPid)
+		}
+		return nil
+	}
+	pids, err := containerProcesses(s)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := unix.Kill(pid, sig); err != nil && err != unix.ESRCH {
+			return errors.Wrapf(err, "signal process %d", pid)
+		}
+	}
+	return nil
+}
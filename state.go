@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var stateFile = "state.json"
+
+var idRegex = regexp.MustCompile(`^[\w+.-]+$`)
+
+// maxIDLength is the longest directory name most filesystems accept
+const maxIDLength = 255
+
+// container status, same values as the OCI runtime spec
+const (
+	stateCreated = "created"
+	stateRunning = "running"
+	stateStopped = "stopped"
+)
+
+// containerState is persisted as state.json in the container directory.
+type containerState struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// InitProcessPid is the pid of the container init on the host.
+	InitProcessPid int `json:"init_process_pid"`
+	// InitProcessStartTime is the start time field of /proc/<pid>/stat,
+	// used to tell whether InitProcessPid was reused by another process.
+	InitProcessStartTime uint64 `json:"init_process_start"`
+	// InitProcessPidNs is the inode of /proc/<pid>/ns/pid of the init, zero
+	// on kernels without namespace files.
+	InitProcessPidNs uint64 `json:"init_process_pidns,omitempty"`
+	// PidNsShared is set when the container joined an existing pid
+	// namespace, whose other processes do not belong to the container.
+	PidNsShared bool              `json:"pidns_shared,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Rootfs      string            `json:"rootfs"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Network is nil without a network namespace of its own.
+	Network *networkConfig `json:"network,omitempty"`
+	// CgroupPaths are the cgroups of the container by subsystem.
+	CgroupPaths map[string]string `json:"cgroup_paths,omitempty"`
+	Created     time.Time         `json:"created"`
+	// ExitStatus of the init process, only known when runns waited for it
+	// in an attached run.
+	ExitStatus *int `json:"exit_status,omitempty"`
+}
+
+// validateID restricts container ids to the charset runc allows, so they
+// are safe to use as a directory name under listPath.
+func validateID(ncName string) error {
+	if ncName == "" {
+		return errors.New("container id can not be empty")
+	}
+	if len(ncName) > maxIDLength {
+		return errors.Errorf("container id %q is longer than %d characters", ncName, maxIDLength)
+	}
+	if !idRegex.MatchString(ncName) || ncName == "." || ncName == ".." {
+		return errors.Errorf("invalid container id %q, only letters, digits, '_', '+', '-' and '.' are allowed", ncName)
+	}
+	return nil
+}
+
+// containerPath is the only place building paths in the state directory of
+// a container. ncName is expected to have passed validateID, the result
+// stays lexically under listPath regardless.
+func containerPath(ncName string, elem ...string) string {
+	return filepath.Join(append([]string{listPath, CleanPath(ncName)}, elem...)...)
+}
+
+// checkListPath fails when there is no state directory.
+func checkListPath() error {
+	return listPathErr
+}
+
+func loadState(ncName string) (*containerState, error) {
+	if err := checkListPath(); err != nil {
+		return nil, err
+	}
+	if err := validateID(ncName); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(containerPath(ncName, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("container %s not exist", ncName)
+		}
+		return nil, errors.Wrap(err, "read state")
+	}
+	var state = new(containerState)
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal state of %s", ncName)
+	}
+	return state, nil
+}
+
+// loadSpec returns the spec saved at create time.
+func loadSpec(ncName string) (*specs.Spec, error) {
+	content, err := ioutil.ReadFile(containerPath(ncName, specConfig))
+	if err != nil {
+		return nil, errors.Wrap(err, "read spec")
+	}
+	var spec = new(specs.Spec)
+	if err := json.Unmarshal(content, spec); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal spec of %s", ncName)
+	}
+	return spec, nil
+}
+
+func (s *containerState) save() error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "marshal state")
+	}
+	return writeFileAtomic(containerPath(s.ID, stateFile), content)
+}
+
+// newContainerDir atomically creates the directory of container ncName,
+// failing when it exists, and returns it locked like lockContainer.
+func newContainerDir(ncName string) (*os.File, error) {
+	if err := checkListPath(); err != nil {
+		return nil, err
+	}
+	if err := validateID(ncName); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(listPath, 0711); err != nil {
+		return nil, errors.Wrap(err, "mkdir for list path")
+	}
+	if err := os.Mkdir(containerPath(ncName), 0711); err != nil {
+		if os.IsExist(err) {
+			return nil, errors.Errorf("container %s exist", ncName)
+		}
+		return nil, errors.Wrap(err, "mkdir for container")
+	}
+	return lockContainer(ncName)
+}
+
+// lockContainer takes the exclusive flock of the container directory,
+// which every command changing the container holds. Closing the returned
+// file releases the lock.
+func lockContainer(ncName string) (*os.File, error) {
+	if err := checkListPath(); err != nil {
+		return nil, err
+	}
+	if err := validateID(ncName); err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(containerPath(ncName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("container %s not exist", ncName)
+		}
+		return nil, errors.Wrap(err, "open container dir")
+	}
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, errors.Wrap(err, "lock container")
+	}
+	// the holder of the lock before may have deleted the container, and
+	// a new one of the same name been created meanwhile
+	locked, err := dir.Stat()
+	if err != nil {
+		dir.Close()
+		return nil, errors.Wrap(err, "stat container dir")
+	}
+	current, err := os.Stat(containerPath(ncName))
+	if err != nil && !os.IsNotExist(err) {
+		dir.Close()
+		return nil, errors.Wrap(err, "stat container dir")
+	}
+	if err != nil || !os.SameFile(locked, current) {
+		dir.Close()
+		return nil, errors.Errorf("container %s not exist", ncName)
+	}
+	return dir, nil
+}
+
+// verifyInit makes sure InitProcessPid still is the init process of the
+// container, and not an unrelated process which reused the pid.
+func (s *containerState) verifyInit() error {
+	procState, startTime, err := getProcessStat(s.InitProcessPid)
+	if err != nil {
+		return errors.Errorf("container %s init process %d is gone", s.ID, s.InitProcessPid)
+	}
+	// a zombie init is as good as dead, nobody may ever reap it after the
+	// create process has gone
+	if procState == "Z" {
+		return errors.Errorf("container %s init process %d has exited", s.ID, s.InitProcessPid)
+	}
+	if startTime != s.InitProcessStartTime {
+		return errors.Errorf("pid %d no longer belongs to container %s", s.InitProcessPid, s.ID)
+	}
+	if s.InitProcessPidNs != 0 {
+		ino, err := getPidNsInode(s.InitProcessPid)
+		if err != nil || ino != s.InitProcessPidNs {
+			return errors.Errorf("pid %d no longer belongs to container %s", s.InitProcessPid, s.ID)
+		}
+	}
+	return nil
+}
+
+// refreshStatus updates Status according to the init process: it is stopped
+// once verifyInit fails, and created until the exec fifo has been consumed
+// by `start`.
+func (s *containerState) refreshStatus() {
+	if err := s.verifyInit(); err != nil {
+		s.Status = stateStopped
+		return
+	}
+	if _, err := os.Stat(containerPath(s.ID, execFifo)); err == nil {
+		s.Status = stateCreated
+	} else {
+		s.Status = stateRunning
+	}
+}
+
+// ociState converts s to the OCI runtime state.
+func (s *containerState) ociState() *specs.State {
+	state := &specs.State{
+		Version:     specs.Version,
+		ID:          s.ID,
+		Status:      s.Status,
+		Bundle:      s.Bundle,
+		Annotations: s.Annotations,
+	}
+	if s.Status != stateStopped {
+		state.Pid = s.InitProcessPid
+	}
+	return state
+}
+
+// killContainer kills every process of the container and waits for its
+// init process to go away.
+func killContainer(s *containerState) error {
+	if err := signalContainer(s, unix.SIGKILL, true); err != nil {
+		return err
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.verifyInit(); err != nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.Errorf("container %s init process %d did not exit after SIGKILL", s.ID, s.InitProcessPid)
+}
+
+// destroyContainer runs the poststop hooks of a stopped container and
+// removes everything left of it on the host.
+func destroyContainer(s *containerState) error {
+	s.Status = stateStopped
+	ncPath := containerPath(s.ID)
+	spec, err := loadSpec(s.ID)
+	if err != nil {
+		return err
+	}
+	if spec.Hooks != nil {
+		for _, hook := range spec.Hooks.Poststop {
+			// the runtime spec wants poststop failures only be logged
+			if err := runHook(hook, s.ociState()); err != nil {
+				logrus.Warnf("poststop hook: %v", err)
+			}
+		}
+	}
+	if err := teardownNetwork(s.ID, s.Network); err != nil {
+		return errors.Wrap(err, "teardown network")
+	}
+	if err := loadCgroupManager(s.CgroupPaths).Destroy(); err != nil {
+		return errors.Wrap(err, "destroy cgroups")
+	}
+	if err := unmountAll(ncPath); err != nil {
+		return errors.Wrap(err, "unmount leftover mounts")
+	}
+	if err := os.RemoveAll(ncPath); err != nil {
+		return errors.Wrap(err, "remove container dir")
+	}
+	return nil
+}
+
+// listStates loads the state of every container under listPath.
+func listStates() ([]*containerState, error) {
+	if err := checkListPath(); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(listPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read dir")
+	}
+	var states []*containerState
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		// skip containers still being created, and whatever else is put
+		// into the state root
+		if validateID(f.Name()) != nil {
+			continue
+		}
+		if _, err := os.Stat(containerPath(f.Name(), stateFile)); os.IsNotExist(err) {
+			continue
+		}
+		state, err := loadState(f.Name())
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// getPidNsInode returns the inode of the pid namespace of pid, or zero when
+// the kernel does not expose /proc/<pid>/ns/pid (before 3.8).
+func getPidNsInode(pid int) (uint64, error) {
+	fi, err := os.Stat(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+				return 0, nil
+			}
+		}
+		return 0, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+// getProcessStartTime returns the starttime field (22nd) of /proc/<pid>/stat.
+func getProcessStartTime(pid int) (uint64, error) {
+	_, startTime, err := getProcessStat(pid)
+	return startTime, err
+}
+
+// getProcessStat returns the state (3rd) and starttime (22nd) fields of
+// /proc/<pid>/stat.
+func getProcessStat(pid int) (string, uint64, error) {
+	fields, err := getProcessStatFields(pid)
+	if err != nil {
+		return "", 0, err
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "parse start time of pid %d", pid)
+	}
+	return fields[0], startTime, nil
+}
+
+// getProcessStatFields returns the fields of /proc/<pid>/stat following
+// comm, the first one being the 3rd field: state.
+func getProcessStatFields(pid int) ([]string, error) {
+	stat, err := FileGetContents(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// comm may contain spaces and parentheses, the fields we want all
+	// come after the last ')'
+	i := strings.LastIndex(stat, ")")
+	if i < 0 {
+		return nil, errors.Errorf("invalid stat of pid %d", pid)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 20 {
+		return nil, errors.Errorf("invalid stat of pid %d", pid)
+	}
+	return fields, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateID(t *testing.T) {
+	for _, tc := range []struct {
+		id    string
+		valid bool
+	}{
+		{"nc1", true},
+		{"a_b+c-d.e", true},
+		{"...", true},
+		{strings.Repeat("a", 255), true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{"../a", false},
+		{"/abs", false},
+		{"a b", false},
+		{strings.Repeat("a", 256), false},
+		{"容器", false},
+		{"café", false},
+	} {
+		err := validateID(tc.id)
+		if (err == nil) != tc.valid {
+			t.Errorf("validateID(%q) = %v, want valid %v", tc.id, err, tc.valid)
+		}
+	}
+}
+
+func TestContainerPath(t *testing.T) {
+	defer func(old string) { listPath = old }(listPath)
+	listPath = "/run/runns"
+	for _, id := range []string{
+		"nc1", "", ".", "..", "a/b", "../a", "../../etc", "/abs", "a/../../b",
+		strings.Repeat("a", 256), "容器",
+	} {
+		for _, elem := range [][]string{nil, {stateFile}} {
+			path := containerPath(id, elem...)
+			rel, err := filepath.Rel(listPath, path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				t.Errorf("containerPath(%q, %v) = %q, outside of %s", id, elem, path, listPath)
+			}
+			// a valid id is the directory right under listPath
+			if validateID(id) == nil && filepath.Dir(containerPath(id)) != listPath {
+				t.Errorf("containerPath(%q) = %q, not a directory of %s", id, containerPath(id), listPath)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// syncType is the type of a message exchanged between runns and the
+// container init over the init pipe.
+type syncType string
+
+const (
+	// runns -> init, carries the bootstrap data
+	syncBootstrap syncType = "bootstrap"
+	// init -> runns, a setup step is about to start
+	syncProgress syncType = "progress"
+	// init -> runns, setup failed, Message says why
+	syncError syncType = "error"
+	// init -> runns, setup is done and init is waiting on the exec fifo
+	syncReady syncType = "ready"
+)
+
+type syncMsg struct {
+	Type      syncType       `json:"type"`
+	Message   string         `json:"message,omitempty"`
+	Bootstrap *bootstrapData `json:"bootstrap,omitempty"`
+}
+
+// bootstrapData is everything the init process needs to set up the
+// container.
+type bootstrapData struct {
+	Spec       *specs.Spec    `json:"spec"`
+	Umask      uint32         `json:"umask"`
+	Domainname string         `json:"domainname,omitempty"`
+	Network    *networkConfig `json:"network,omitempty"`
+	Rootless   bool           `json:"rootless,omitempty"`
+}
+
+// syncPipe is one end of the init pipe, a socketpair carrying a stream of
+// JSON encoded syncMsg.
+type syncPipe struct {
+	file *os.File
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func newSyncPipe(file *os.File) *syncPipe {
+	return &syncPipe{
+		file: file,
+		enc:  json.NewEncoder(file),
+		dec:  json.NewDecoder(file),
+	}
+}
+
+// newSyncPipePair returns the runns end and the init end of a new init pipe.
+func newSyncPipePair() (*syncPipe, *os.File, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "socketpair")
+	}
+	return newSyncPipe(os.NewFile(uintptr(fds[0]), "initpipe-parent")), os.NewFile(uintptr(fds[1]), "initpipe-child"), nil
+}
+
+func (p *syncPipe) send(msg *syncMsg) error {
+	return p.enc.Encode(msg)
+}
+
+func (p *syncPipe) recv() (*syncMsg, error) {
+	var msg = new(syncMsg)
+	if err := p.dec.Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (p *syncPipe) progress(message string) error {
+	return p.send(&syncMsg{Type: syncProgress, Message: message})
+}
+
+func (p *syncPipe) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+var updateCommand = &command{
+	Name:      "update",
+	ArgsUsage: "<container-id>",
+	Usage:     "update the resource limits of a created or running container",
+	Flags: func(fs *flag.FlagSet) {
+		stringFlag(fs, "resources, r", "", "path to a JSON file of linux.resources to apply, - for stdin")
+		stringFlag(fs, "cpuset-cpus", "", "CPUs the container may use, e.g. 0-3,6")
+		stringFlag(fs, "cpuset-mems", "", "memory nodes the container may use, e.g. 0,1")
+		stringFlag(fs, "cpu-shares", "", "relative CPU weight")
+		stringFlag(fs, "cpu-period", "", "CPU CFS period in microseconds")
+		stringFlag(fs, "cpu-quota", "", "CPU CFS quota in microseconds per period, -1 for none")
+		stringFlag(fs, "memory", "", "memory limit, e.g. 512m, -1 for none")
+		stringFlag(fs, "memory-reservation", "", "memory soft limit")
+		stringFlag(fs, "memory-swap", "", "memory plus swap limit, -1 for none")
+		stringFlag(fs, "pids-limit", "", "maximum number of processes, -1 for none")
+		stringFlag(fs, "blkio-weight", "", "relative block I/O weight, 10 to 1000")
+	},
+	MinArgs: 1,
+	MaxArgs: 1,
+	Action:  update,
+}
+
+func update(ctx *context) error {
+	ncName := ctx.Args()[0]
+	r, err := updateResources(ctx)
+	if err != nil {
+		return err
+	}
+	lock, err := lockContainer(ncName)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	state, err := loadState(ncName)
+	if err != nil {
+		return err
+	}
+	state.refreshStatus()
+	if state.Status == stateStopped {
+		return errors.Errorf("container %s is not running", ncName)
+	}
+	if len(state.CgroupPaths) == 0 {
+		return errors.Errorf("container %s has no cgroups", ncName)
+	}
+	// the spec saved at create time keeps the resources up to date, for
+	// the limits set in pairs and the next update
+	spec, err := loadSpec(ncName)
+	if err != nil {
+		return err
+	}
+	if spec.Linux == nil {
+		spec.Linux = new(specs.Linux)
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = new(specs.LinuxResources)
+	}
+	current := spec.Linux.Resources
+	// cgroup v2 sets the cpu quota with the period, and the swap limit
+	// relative to the memory limit
+	if r.CPU != nil && (r.CPU.Quota != nil || r.CPU.Period != nil) && current.CPU != nil {
+		if r.CPU.Quota == nil {
+			r.CPU.Quota = current.CPU.Quota
+		}
+		if r.CPU.Period == nil {
+			r.CPU.Period = current.CPU.Period
+		}
+	}
+	if r.Memory != nil && r.Memory.Swap != nil && r.Memory.Limit == nil && current.Memory != nil {
+		r.Memory.Limit = current.Memory.Limit
+	}
+	if err := checkCpuset(state.CgroupPaths, r.CPU); err != nil {
+		return err
+	}
+	// the resources are set one after the other, the spec keeps the ones
+	// set before one fails
+	m := loadCgroupManager(state.CgroupPaths)
+	var setErr error
+	for _, part := range splitResources(r) {
+		if setErr = m.Set(part); setErr != nil {
+			setErr = errors.Wrap(setErr, "set cgroup resources")
+			break
+		}
+		mergeResources(current, part)
+	}
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return errors.Wrap(err, "marshal spec")
+	}
+	if err := writeFileAtomic(containerPath(ncName, specConfig), content); err != nil {
+		return err
+	}
+	return setErr
+}
+
+// splitResources splits r into the resources set together.
+func splitResources(r *specs.LinuxResources) []*specs.LinuxResources {
+	var parts []*specs.LinuxResources
+	if r.Memory != nil {
+		parts = append(parts, &specs.LinuxResources{Memory: r.Memory})
+	}
+	if r.CPU != nil {
+		cpu := *r.CPU
+		cpu.Cpus, cpu.Mems = "", ""
+		if cpu != (specs.LinuxCPU{}) {
+			parts = append(parts, &specs.LinuxResources{CPU: &cpu})
+		}
+		if r.CPU.Cpus != "" || r.CPU.Mems != "" {
+			parts = append(parts, &specs.LinuxResources{CPU: &specs.LinuxCPU{Cpus: r.CPU.Cpus, Mems: r.CPU.Mems}})
+		}
+	}
+	if r.BlockIO != nil {
+		parts = append(parts, &specs.LinuxResources{BlockIO: r.BlockIO})
+	}
+	if r.Pids != nil {
+		parts = append(parts, &specs.LinuxResources{Pids: r.Pids})
+	}
+	return parts
+}
+
+// checkCpuset makes sure the cpus and mems of cpu are within the ones of
+// the parent cgroup, which the kernel would refuse only once other
+// resources are set.
+func checkCpuset(paths map[string]string, cpu *specs.LinuxCPU) error {
+	if cpu == nil {
+		return nil
+	}
+	dir, suffix := paths["cpuset"], ""
+	if v2, ok := paths[cgroupV2Key]; ok {
+		dir, suffix = v2, ".effective"
+	}
+	if dir == "" {
+		return nil
+	}
+	for _, c := range []struct{ name, value string }{{"cpus", cpu.Cpus}, {"mems", cpu.Mems}} {
+		if c.value == "" {
+			continue
+		}
+		ids, err := parseCPUList(c.value)
+		if err != nil {
+			return errors.Errorf("invalid cpuset %s %q", c.name, c.value)
+		}
+		// the kernel checks what can not be read here
+		parentValue, err := readCgroupFile(filepath.Dir(dir), "cpuset."+c.name+suffix)
+		if err != nil {
+			continue
+		}
+		parentIDs, err := parseCPUList(parentValue)
+		if err != nil {
+			continue
+		}
+		parentSet := make(map[int]bool)
+		for _, id := range parentIDs {
+			parentSet[id] = true
+		}
+		for _, id := range ids {
+			if !parentSet[id] {
+				return errors.Errorf("cpuset %s %s are not within %s of the parent cgroup", c.name, c.value, parentValue)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCPUList parses a list of cpus or memory nodes like 0-3,6.
+func parseCPUList(list string) ([]int, error) {
+	var ids []int
+	if list == "" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if first < 0 || last < first {
+			return nil, errors.Errorf("invalid range %q", part)
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// updateResources returns the resources of the --resources file, with the
+// ones of the other flags on top.
+func updateResources(ctx *context) (*specs.LinuxResources, error) {
+	var r = new(specs.LinuxResources)
+	if path := ctx.String("resources"); path != "" {
+		var content []byte
+		var err error
+		if path == "-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			content, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read resources")
+		}
+		if err := json.Unmarshal(content, r); err != nil {
+			return nil, errors.Wrap(err, "unmarshal resources")
+		}
+		if r.Devices != nil {
+			return nil, errors.New("device rules can not be updated")
+		}
+	}
+
+	cpu := new(specs.LinuxCPU)
+	cpu.Cpus = ctx.String("cpuset-cpus")
+	cpu.Mems = ctx.String("cpuset-mems")
+	var err error
+	if cpu.Shares, err = uintFlag(ctx, "cpu-shares"); err != nil {
+		return nil, err
+	}
+	if cpu.Period, err = uintFlag(ctx, "cpu-period"); err != nil {
+		return nil, err
+	}
+	if cpu.Quota, err = intFlag(ctx, "cpu-quota", strconv.ParseInt); err != nil {
+		return nil, err
+	}
+	if *cpu != (specs.LinuxCPU{}) {
+		if r.CPU == nil {
+			r.CPU = new(specs.LinuxCPU)
+		}
+		mergeCPU(r.CPU, cpu)
+	}
+
+	memory := new(specs.LinuxMemory)
+	if memory.Limit, err = intFlag(ctx, "memory", parseBytes); err != nil {
+		return nil, err
+	}
+	if memory.Reservation, err = intFlag(ctx, "memory-reservation", parseBytes); err != nil {
+		return nil, err
+	}
+	if memory.Swap, err = intFlag(ctx, "memory-swap", parseBytes); err != nil {
+		return nil, err
+	}
+	if memory.Limit != nil || memory.Reservation != nil || memory.Swap != nil {
+		if r.Memory == nil {
+			r.Memory = new(specs.LinuxMemory)
+		}
+		mergeMemory(r.Memory, memory)
+	}
+
+	pids, err := intFlag(ctx, "pids-limit", strconv.ParseInt)
+	if err != nil {
+		return nil, err
+	}
+	if pids != nil {
+		r.Pids = &specs.LinuxPids{Limit: *pids}
+	}
+
+	weight, err := uintFlag(ctx, "blkio-weight")
+	if err != nil {
+		return nil, err
+	}
+	if weight != nil {
+		if *weight > blkioWeightMax {
+			return nil, errors.Errorf("invalid --blkio-weight value %d", *weight)
+		}
+		if r.BlockIO == nil {
+			r.BlockIO = new(specs.LinuxBlockIO)
+		}
+		w := uint16(*weight)
+		r.BlockIO.Weight = &w
+	}
+
+	if !hasResourceLimits(r) {
+		return nil, errors.New("nothing to update, give --resources or a resource flag")
+	}
+	return r, nil
+}
+
+func intFlag(ctx *context, name string, parse func(s string, base int, bitSize int) (int64, error)) (*int64, error) {
+	value := ctx.String(name)
+	if value == "" {
+		return nil, nil
+	}
+	v, err := parse(value, 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid --%s value %q", name, value)
+	}
+	return &v, nil
+}
+
+func uintFlag(ctx *context, name string) (*uint64, error) {
+	value := ctx.String(name)
+	if value == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid --%s value %q", name, value)
+	}
+	return &v, nil
+}
+
+// parseBytes parses a size like 512m, with a k, m, g or t suffix in powers
+// of 1024, the signature is the one of strconv.ParseInt.
+func parseBytes(s string, base int, bitSize int) (int64, error) {
+	value := strings.TrimSuffix(strings.ToLower(s), "b")
+	var unit int64 = 1
+	if n := len(value); n > 0 {
+		if i := strings.IndexByte("kmgt", value[n-1]); i >= 0 {
+			unit = 1 << (10 * uint(i+1))
+			value = value[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(value, base, bitSize)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 && unit != 1 {
+		return 0, errors.Errorf("negative size %q", s)
+	}
+	return v * unit, nil
+}
+
+// mergeResources sets the resources of src on dst.
+func mergeResources(dst, src *specs.LinuxResources) {
+	if src.CPU != nil {
+		if dst.CPU == nil {
+			dst.CPU = new(specs.LinuxCPU)
+		}
+		mergeCPU(dst.CPU, src.CPU)
+	}
+	if src.Memory != nil {
+		if dst.Memory == nil {
+			dst.Memory = new(specs.LinuxMemory)
+		}
+		mergeMemory(dst.Memory, src.Memory)
+	}
+	if src.Pids != nil {
+		dst.Pids = src.Pids
+	}
+	if src.BlockIO != nil {
+		if dst.BlockIO == nil {
+			dst.BlockIO = new(specs.LinuxBlockIO)
+		}
+		mergeBlockIO(dst.BlockIO, src.BlockIO)
+	}
+}
+
+func mergeCPU(dst, src *specs.LinuxCPU) {
+	if src.Shares != nil {
+		dst.Shares = src.Shares
+	}
+	if src.Quota != nil {
+		dst.Quota = src.Quota
+	}
+	if src.Period != nil {
+		dst.Period = src.Period
+	}
+	if src.Cpus != "" {
+		dst.Cpus = src.Cpus
+	}
+	if src.Mems != "" {
+		dst.Mems = src.Mems
+	}
+}
+
+func mergeMemory(dst, src *specs.LinuxMemory) {
+	if src.Limit != nil {
+		dst.Limit = src.Limit
+	}
+	if src.Reservation != nil {
+		dst.Reservation = src.Reservation
+	}
+	if src.Swap != nil {
+		dst.Swap = src.Swap
+	}
+}
+
+// mergeBlockIO sets the weights of src on dst, device entries replacing
+// the ones of dst for the same device.
+func mergeBlockIO(dst, src *specs.LinuxBlockIO) {
+	if src.Weight != nil {
+		dst.Weight = src.Weight
+	}
+	if src.LeafWeight != nil {
+		dst.LeafWeight = src.LeafWeight
+	}
+	for _, d := range src.WeightDevice {
+		i := 0
+		for ; i < len(dst.WeightDevice); i++ {
+			if dst.WeightDevice[i].Major == d.Major && dst.WeightDevice[i].Minor == d.Minor {
+				break
+			}
+		}
+		if i == len(dst.WeightDevice) {
+			dst.WeightDevice = append(dst.WeightDevice, d)
+			continue
+		}
+		if d.Weight != nil {
+			dst.WeightDevice[i].Weight = d.Weight
+		}
+		if d.LeafWeight != nil {
+			dst.WeightDevice[i].LeafWeight = d.LeafWeight
+		}
+	}
+	dst.ThrottleReadBpsDevice = mergeThrottles(dst.ThrottleReadBpsDevice, src.ThrottleReadBpsDevice)
+	dst.ThrottleWriteBpsDevice = mergeThrottles(dst.ThrottleWriteBpsDevice, src.ThrottleWriteBpsDevice)
+	dst.ThrottleReadIOPSDevice = mergeThrottles(dst.ThrottleReadIOPSDevice, src.ThrottleReadIOPSDevice)
+	dst.ThrottleWriteIOPSDevice = mergeThrottles(dst.ThrottleWriteIOPSDevice, src.ThrottleWriteIOPSDevice)
+}
+
+func mergeThrottles(dst, src []specs.LinuxThrottleDevice) []specs.LinuxThrottleDevice {
+	for _, d := range src {
+		i := 0
+		for ; i < len(dst); i++ {
+			if dst[i].Major == d.Major && dst[i].Minor == d.Minor {
+				dst[i].Rate = d.Rate
+				break
+			}
+		}
+		if i == len(dst) {
+			dst = append(dst, d)
+		}
+	}
+	return dst
+}
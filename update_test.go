@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseBytes(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"1024", 1024, false},
+		{"-1", -1, false},
+		{"512k", 512 << 10, false},
+		{"64m", 64 << 20, false},
+		{"64MB", 64 << 20, false},
+		{"2g", 2 << 30, false},
+		{"1t", 1 << 40, false},
+		{"-1m", 0, true},
+		{"1x", 0, true},
+		{"m", 0, true},
+		{"", 0, true},
+	} {
+		got, err := parseBytes(tc.in, 10, 64)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []int
+		err  bool
+	}{
+		{"0", []int{0}, false},
+		{"0-3,6", []int{0, 1, 2, 3, 6}, false},
+		{"2,4-5", []int{2, 4, 5}, false},
+		{"3-1", nil, true},
+		{"1-x", nil, true},
+		{"a", nil, true},
+	} {
+		got, err := parseCPUList(tc.in)
+		if (err != nil) != tc.err || (!tc.err && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("parseCPUList(%q) = %v, %v, want %v, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestSplitResources(t *testing.T) {
+	limit, shares := int64(64<<20), uint64(512)
+	r := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+		CPU:    &specs.LinuxCPU{Shares: &shares, Cpus: "0"},
+		Pids:   &specs.LinuxPids{Limit: 20},
+	}
+	parts := splitResources(r)
+	if len(parts) != 4 {
+		t.Fatalf("splitResources returned %d parts, want 4", len(parts))
+	}
+	if parts[1].CPU.Cpus != "" || parts[1].CPU.Shares == nil {
+		t.Errorf("cpu part %+v has the cpuset", parts[1].CPU)
+	}
+	if parts[2].CPU.Cpus != "0" || parts[2].CPU.Shares != nil {
+		t.Errorf("cpuset part %+v has more than the cpuset", parts[2].CPU)
+	}
+	merged := new(specs.LinuxResources)
+	for _, part := range parts {
+		mergeResources(merged, part)
+	}
+	if !reflect.DeepEqual(merged, r) {
+		t.Errorf("merged parts %+v, want %+v", merged, r)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// paths inside the container, read after jailing into the rootfs
+var passwdPath = "/etc/passwd"
+var groupPath = "/etc/group"
+
+// execUser is the resolved identity of the container process.
+type execUser struct {
+	Uid   int
+	Gid   int
+	Sgids []int
+}
+
+// resolveUser turns the spec user into ids. When Username is set, uid and
+// gid come from the container's /etc/passwd, and the groups listing the
+// user in /etc/group are added to the supplementary groups.
+func resolveUser(user specs.User) (*execUser, error) {
+	u := &execUser{
+		Uid: int(user.UID),
+		Gid: int(user.GID),
+	}
+	if user.Username != "" {
+		entry, err := findPasswdEntry(user.Username)
+		if err != nil {
+			return nil, err
+		}
+		if u.Uid, err = strconv.Atoi(entry[2]); err != nil {
+			return nil, errors.Wrapf(err, "invalid uid of user %s", user.Username)
+		}
+		if u.Gid, err = strconv.Atoi(entry[3]); err != nil {
+			return nil, errors.Wrapf(err, "invalid gid of user %s", user.Username)
+		}
+		if u.Sgids, err = findGroupsOf(user.Username); err != nil {
+			return nil, err
+		}
+	}
+	for _, gid := range user.AdditionalGids {
+		u.Sgids = append(u.Sgids, int(gid))
+	}
+	return u, nil
+}
+
+// readColonFile returns the colon separated fields of every line of path,
+// skipping comments and lines with less than n fields.
+func readColonFile(path string, n int) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < n {
+			continue
+		}
+		entries = append(entries, fields)
+	}
+	return entries, s.Err()
+}
+
+func findPasswdEntry(username string) ([]string, error) {
+	entries, err := readColonFile(passwdPath, 7)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", passwdPath)
+	}
+	for _, entry := range entries {
+		if entry[0] == username {
+			return entry, nil
+		}
+	}
+	return nil, errors.Errorf("user %s not found in %s", username, passwdPath)
+}
+
+func findGroupsOf(username string) ([]int, error) {
+	entries, err := readColonFile(groupPath, 4)
+	if err != nil {
+		// a rootfs without /etc/group just has no supplementary groups
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read %s", groupPath)
+	}
+	var gids []int
+	for _, entry := range entries {
+		if !IsInStringArray(username, strings.Split(entry[3], ",")) {
+			continue
+		}
+		gid, err := strconv.Atoi(entry[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid gid of group %s", entry[0])
+		}
+		gids = append(gids, gid)
+	}
+	return gids, nil
+}
+
+// setupUser switches the current thread to u. The raw syscalls only change
+// the calling thread, the caller must be locked to the thread which execs
+// the container process. The supplementary groups are kept unless
+// setgroups, it is denied in a user namespace of a rootless container.
+func setupUser(u *execUser, setgroups bool) error {
+	if setgroups {
+		if err := unix.Setgroups(u.Sgids); err != nil {
+			return errors.Wrap(err, "setgroups")
+		}
+	}
+	if err := unix.Setresgid(u.Gid, u.Gid, u.Gid); err != nil {
+		return errors.Wrapf(err, "setgid %d", u.Gid)
+	}
+	if err := unix.Setresuid(u.Uid, u.Uid, u.Uid); err != nil {
+		return errors.Wrapf(err, "setuid %d", u.Uid)
+	}
+	return nil
+}
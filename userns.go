@@ -0,0 +1,67 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// setupUserNamespace makes attr map the ids of the user namespace of spec.
+//
+// The Go runtime does the handshake runc does with its nsexec: the cloned
+// child waits on a pipe until the parent has written /proc/<pid>/uid_map,
+// setgroups and gid_map. The child then switches to root of the namespace
+// before exec'ing init, so init keeps its capabilities in the namespace
+// while being an unprivileged uid on the host.
+func setupUserNamespace(attr *unix.SysProcAttr, spec *specs.Spec) error {
+	var uidMappings, gidMappings []specs.LinuxIDMapping
+	if spec.Linux != nil {
+		uidMappings, gidMappings = spec.Linux.UIDMappings, spec.Linux.GIDMappings
+	}
+	if !hasNamespace(spec, specs.UserNamespace) {
+		if len(uidMappings) > 0 || len(gidMappings) > 0 {
+			return errors.New("uid and gid mappings need a user namespace")
+		}
+		return nil
+	}
+	if len(uidMappings) == 0 || len(gidMappings) == 0 {
+		return errors.New("user namespace needs uid and gid mappings")
+	}
+	var err error
+	if attr.UidMappings, err = idMappings("uid", uidMappings); err != nil {
+		return err
+	}
+	if attr.GidMappings, err = idMappings("gid", gidMappings); err != nil {
+		return err
+	}
+	// an unprivileged user may write gid_map only with setgroups denied
+	attr.GidMappingsEnableSetgroups = !rootless
+	attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: rootless}
+	return nil
+}
+
+// idMappings converts the spec mappings of kind uid or gid, which have to
+// map root of the namespace, init runs as root until it execs.
+func idMappings(kind string, mappings []specs.LinuxIDMapping) ([]syscall.SysProcIDMap, error) {
+	var maps []syscall.SysProcIDMap
+	var hasRoot bool
+	for _, m := range mappings {
+		if m.Size == 0 {
+			return nil, errors.Errorf("empty %s mapping of container id %d", kind, m.ContainerID)
+		}
+		if m.ContainerID == 0 {
+			hasRoot = true
+		}
+		maps = append(maps, syscall.SysProcIDMap{
+			ContainerID: int(m.ContainerID),
+			HostID:      int(m.HostID),
+			Size:        int(m.Size),
+		})
+	}
+	if !hasRoot {
+		return nil, errors.Errorf("%s mappings do not map %s 0 of the container", kind, kind)
+	}
+	return maps, nil
+}
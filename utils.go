@@ -192,6 +192,9 @@ func prepareConfig(spec *specs.Spec) (*configs.Config, error) {
 	for _, m := range spec.Mounts {
 		config.Mounts = append(config.Mounts, createLibcontainerMount(cwd, m))
 	}
+	if config.Devices, err = containerDevices(spec); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
@@ -234,6 +237,97 @@ func initSpec(sepcConf string) (*specs.Spec, error) {
 	return spec, validateProcessSpec(spec.Process)
 }
 
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// processEnv returns the environment of the container process, which is
+// env plus a default PATH when env does not set one.
+func processEnv(env []string) []string {
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			return env
+		}
+	}
+	return append(append([]string{}, env...), defaultPath)
+}
+
+// lookPath searches file like exec.LookPath, but in the PATH of env rather
+// than the one of the current process. It has to be called after jailing
+// into the rootfs, so PATH is looked up in the container.
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		if err := findExecutable(file); err != nil {
+			return "", errors.Wrapf(err, "%s", file)
+		}
+		return file, nil
+	}
+	var pathEnv string
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			pathEnv = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			// Unix shell semantics: path element "" means "."
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		if err := findExecutable(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("executable file %q not found in $PATH %q", file, pathEnv)
+}
+
+func findExecutable(file string) error {
+	d, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if m := d.Mode(); !m.IsDir() && m&0111 != 0 {
+		return nil
+	}
+	return os.ErrPermission
+}
+
+// defaultUmask is applied when the spec does not set one, like runc.
+const defaultUmask = 0022
+
+// specExtras are the spec fields only known to runtime-spec releases newer
+// than the vendored one, decoded from the spec file on their own.
+type specExtras struct {
+	// Umask is process.user.umask
+	Umask uint32
+	// Domainname is the NIS domain name set in a new UTS namespace
+	Domainname string
+}
+
+func loadSpecExtras(sepcConf string) (*specExtras, error) {
+	content, err := ioutil.ReadFile(sepcConf)
+	if err != nil {
+		return nil, err
+	}
+	var spec struct {
+		Process *struct {
+			User struct {
+				Umask *uint32 `json:"umask"`
+			} `json:"user"`
+		} `json:"process"`
+		Domainname string `json:"domainname"`
+	}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return nil, err
+	}
+	extras := &specExtras{
+		Umask:      defaultUmask,
+		Domainname: spec.Domainname,
+	}
+	if spec.Process != nil && spec.Process.User.Umask != nil {
+		extras.Umask = *spec.Process.User.Umask
+	}
+	return extras, nil
+}
+
 func IsInStringArray(val string, array []string) bool {
 	for _, ele := range array {
 		if ele == val {
@@ -259,6 +353,34 @@ func FilePutContents(filename string, content string, modAppend bool) error {
 	return err
 }
 
+// writeFileAtomic replaces filename with content through a temporary file
+// renamed over it, so readers never see a partially written file.
+func writeFileAtomic(filename string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
 func FileGetContents(file string) (string, error) {
 	content, err := ioutil.ReadFile(file)
 	if err != nil {